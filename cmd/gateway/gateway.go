@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/player"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// command is what the browser sends. The first one has to be a login to a
+// game. A browser that lost its socket can bring the token from its welcome
+// to take the username back before the server notices it's gone:
+//
+//	{"type": "login", "game": "europe-1", "username": "alice", "token": "9f86d0..."}
+//	{"type": "spawn", "args": ["europe", "infantry"]}
+//	{"type": "move", "args": ["asia", "1"]}
+//	{"type": "status"}
+type command struct {
+	Type     string   `json:"type"`
+	Game     string   `json:"game,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Args     []string `json:"args,omitempty"`
+}
+
+// event is what the gateway sends back: the answer to a command, or a pause,
+// move, war or presence notice the player's handlers dealt with (Result says
+// how). The welcome carries the token to log in as the same username again
+// while it is still ours.
+type event struct {
+	Type   string            `json:"type"`
+	Body   any               `json:"body,omitempty"`
+	Result string            `json:"result,omitempty"`
+	Player *gamelogic.Player `json:"player,omitempty"`
+	Token  string            `json:"token,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+const (
+	loginTimeout = 30 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+type gateway struct {
+	ctx      context.Context
+	broker   pubsub.Broker
+	upgrader websocket.Upgrader
+	sessions sync.WaitGroup
+
+	mu     sync.Mutex
+	online map[seat]bool
+}
+
+// seat is a player in a game. The same username can play in several games.
+type seat struct {
+	game     string
+	username string
+}
+
+func newGateway(ctx context.Context, broker pubsub.Broker) *gateway {
+	return &gateway{
+		ctx:    ctx,
+		broker: broker,
+		online: map[seat]bool{},
+	}
+}
+
+// allowOrigins lets pages served from origins connect. By default only
+// pages from the gateway's own host can.
+func (g *gateway) allowOrigins(origins []string) {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	g.upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowed[origin] || origin == "http://"+r.Host || origin == "https://"+r.Host
+	}
+}
+
+func (g *gateway) wait() {
+	g.sessions.Wait()
+}
+
+func (g *gateway) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has answered the request already.
+		return
+	}
+	g.sessions.Add(1)
+	defer g.sessions.Done()
+	defer conn.Close()
+
+	s := &session{conn: conn}
+	st, token, err := g.login(s)
+	if err != nil {
+		s.send(event{Type: "error", Error: err.Error()})
+		return
+	}
+	defer g.logout(st)
+
+	// Closing the socket is the only way to interrupt ReadJSON.
+	ctx, cancel := context.WithCancel(g.ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := s.play(ctx, g, st, token); err != nil {
+		fmt.Printf("session of %s in %s ended: %s\n", st.username, st.game, err)
+	}
+}
+
+// login reads the first command and claims its seat on this gateway. The
+// token is checked by the server when the player joins, before anything is
+// subscribed or signed on the player's behalf.
+func (g *gateway) login(s *session) (seat, string, error) {
+	s.conn.SetReadDeadline(time.Now().Add(loginTimeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	var cmd command
+	if err := s.conn.ReadJSON(&cmd); err != nil {
+		return seat{}, "", fmt.Errorf("reading login: %w", err)
+	}
+	if cmd.Type != "login" {
+		return seat{}, "", errors.New("log in first")
+	}
+	if !routing.ValidName(cmd.Game) || !routing.ValidName(cmd.Username) {
+		return seat{}, "", errors.New("games and usernames are 1 to 32 letters, digits, dashes or underscores")
+	}
+
+	st := seat{game: cmd.Game, username: cmd.Username}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.online[st] {
+		return seat{}, "", fmt.Errorf("%s is already playing in %s", st.username, st.game)
+	}
+	g.online[st] = true
+	return st, cmd.Token, nil
+}
+
+func (g *gateway) logout(st seat) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.online, st)
+}
+
+// session is one browser's connection. Handlers run on subscription
+// goroutines, so writes are serialized.
+type session struct {
+	conn *websocket.Conn
+	wmu  sync.Mutex
+}
+
+func (s *session) send(ev event) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return s.conn.WriteJSON(ev)
+}
+
+// play joins the seat's game and runs the browser's commands until the
+// socket closes.
+func (s *session) play(ctx context.Context, g *gateway, st seat, token string) error {
+	p, err := player.Join(ctx, g.broker, st.game, st.username, token, player.Middleware{
+		Pause: []pubsub.Middleware[routing.PlayingState]{forward[routing.PlayingState](s, "pause")},
+		Moves: []pubsub.Middleware[gamelogic.ArmyMove]{forward[gamelogic.ArmyMove](s, "move")},
+		Wars:  []pubsub.Middleware[gamelogic.WarResult]{forward[gamelogic.WarResult](s, "war")},
+		Lobby: []pubsub.Middleware[routing.Presence]{forward[routing.Presence](s, "presence")},
+	})
+	if err != nil {
+		s.send(event{Type: "error", Error: "could not join the game: " + err.Error()})
+		return err
+	}
+	defer p.Close()
+
+	snap := p.State.GetPlayerSnap()
+	if err := s.send(event{Type: "welcome", Player: &snap, Token: p.Token()}); err != nil {
+		return err
+	}
+
+	for {
+		var cmd command
+		if err := s.conn.ReadJSON(&cmd); err != nil {
+			break
+		}
+		if err := s.handle(ctx, p, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle runs one command. Only failing to answer ends the session; a bad
+// command gets an error event.
+func (s *session) handle(ctx context.Context, p *player.Player, cmd command) error {
+	words := append([]string{cmd.Type}, cmd.Args...)
+	switch cmd.Type {
+	case "spawn":
+		if _, err := p.Spawn(ctx, words); err != nil {
+			return s.send(event{Type: "error", Error: err.Error()})
+		}
+		snap := p.State.GetPlayerSnap()
+		return s.send(event{Type: "spawned", Player: &snap})
+	case "move":
+		move, err := p.Move(ctx, words)
+		if err != nil {
+			return s.send(event{Type: "error", Error: err.Error()})
+		}
+		return s.send(event{Type: "moved", Body: move})
+	case "status":
+		snap := p.State.GetPlayerSnap()
+		return s.send(event{Type: "status", Player: &snap})
+	default:
+		return s.send(event{Type: "error", Error: fmt.Sprintf("unknown command %q", cmd.Type)})
+	}
+}
+
+// forward tells the browser about every message the player's handler
+// settled. Messages that will come back (retried or requeued) are only
+// reported once they are done with.
+func forward[T any](s *session, kind string) pubsub.Middleware[T] {
+	return func(next pubsub.Handler[T]) pubsub.Handler[T] {
+		return func(d pubsub.Delivery[T]) pubsub.Acktype {
+			acktype := next(d)
+			if acktype == pubsub.NackRetry || acktype == pubsub.NackRequeue {
+				return acktype
+			}
+			if err := s.send(event{Type: kind, Body: d.Body, Result: acktype.String()}); err != nil {
+				fmt.Printf("could not forward %s: %s\n", kind, err)
+			}
+			return acktype
+		}
+	}
+}
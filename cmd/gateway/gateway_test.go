@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// fakeServer answers what player.Join asks the server, registering players
+// in lobby the way the real server does.
+func fakeServer(t *testing.T, ctx context.Context, broker pubsub.Broker, lobby *gamelogic.Lobby) {
+	t.Helper()
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(routing.ExchangePerilDirect, pubsub.ExchangeDirect, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(routing.ExchangePerilTopic, pubsub.ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var subs []*pubsub.Subscription
+	add := func(sub *pubsub.Subscription, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+	add(pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RegisterRPCKey, routing.RegisterRPCKey, pubsub.SimpleQueueTypeDurable,
+		func(_ context.Context, req gamelogic.PlayerRequest) (gamelogic.Registration, error) {
+			token, err := lobby.Register(req.GameID, req.Username, req.Token, time.Now())
+			if err != nil {
+				return gamelogic.Registration{}, err
+			}
+			_, key, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				return gamelogic.Registration{}, err
+			}
+			return gamelogic.Registration{Key: key, ServerKey: serverKey, SealKey: pubsub.NewSealKey(), Token: token}, nil
+		}, nil))
+	add(pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.PlayingStateRPCKey, routing.PlayingStateRPCKey, pubsub.SimpleQueueTypeDurable,
+		func(context.Context, string) (routing.PlayingState, error) {
+			return routing.PlayingState{}, nil
+		}, nil))
+	add(pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.PlayerRPCKey, routing.PlayerRPCKey, pubsub.SimpleQueueTypeDurable,
+		func(_ context.Context, req gamelogic.PlayerRequest) (gamelogic.Player, error) {
+			return gamelogic.Player{Username: req.Username, Units: map[int]gamelogic.Unit{}}, nil
+		}, nil))
+	add(pubsub.Subscribe(ctx, broker, routing.ExchangePerilTopic, routing.PresencePrefix, routing.GameKey(routing.PresencePrefix, "*", "*"), pubsub.SimpleQueueTypeDurable,
+		func(p routing.Presence) pubsub.Acktype {
+			lobby.Update(p, time.Now())
+			return pubsub.Ack
+		}))
+	t.Cleanup(func() {
+		for _, sub := range subs {
+			sub.Close()
+		}
+	})
+}
+
+func login(t *testing.T, url, game, username, token string) (*websocket.Conn, event) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(command{Type: "login", Game: game, Username: username, Token: token}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var ev event
+	if err := conn.ReadJSON(&ev); err != nil {
+		t.Fatal(err)
+	}
+	return conn, ev
+}
+
+func TestLoginHoldsNameWhilePlaying(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := pubsub.NewMemoryBroker().Dial()
+	defer broker.Close()
+	lobby := gamelogic.NewLobby()
+	fakeServer(t, ctx, broker, lobby)
+
+	g := newGateway(ctx, broker)
+	srv := httptest.NewServer(http.HandlerFunc(g.serveWS))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	alice, welcome := login(t, url, "g1", "alice", "")
+	if welcome.Type != "welcome" || welcome.Token == "" {
+		t.Fatalf("alice got %+v, want a welcome with a token", welcome)
+	}
+	if _, ev := login(t, url, "g1", "alice", ""); ev.Type != "error" {
+		t.Errorf("a second socket joined as alice while she plays: %+v", ev)
+	}
+
+	alice.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for online(lobby, "g1", "alice") || seated(g, "g1", "alice") {
+		if time.Now().After(deadline) {
+			t.Fatal("alice never left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once she has left, the name is anybody's, with a token of its own.
+	if _, ev := login(t, url, "g1", "alice", ""); ev.Type != "welcome" || ev.Token == "" || ev.Token == welcome.Token {
+		t.Errorf("a new player taking alice's name after she left got %+v", ev)
+	}
+}
+
+func online(lobby *gamelogic.Lobby, game, username string) bool {
+	for _, pp := range lobby.List() {
+		if pp.GameID == game && pp.Username == username {
+			return pp.Online
+		}
+	}
+	return false
+}
+
+func seated(g *gateway, game, username string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.online[seat{game: game, username: username}]
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to serve WebSocket connections on")
+	origins := flag.String("origins", "", "comma-separated origins allowed to connect besides the gateway's own")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Apply()
+
+	fmt.Println("Starting Peril gateway...")
+
+	// Ctrl+C or a SIGTERM cancels ctx, which ends every player's session.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	broker, err := cfg.Broker.Dial(pubsub.DefaultBackoff)
+	if err != nil {
+		log.Fatalf("could not connect to %s: %s", cfg.Broker.RedactedURL(), err)
+	}
+	defer broker.Close()
+
+	g := newGateway(ctx, broker)
+	if *origins != "" {
+		g.allowOrigins(strings.Split(*origins, ","))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", g.serveWS)
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("Listening on %s\n", *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// Shutdown doesn't wait for hijacked connections.
+	g.wait()
+	fmt.Println("Shutting down...")
+}
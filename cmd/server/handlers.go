@@ -1,21 +1,168 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
-func handlerLog() func(gamelog routing.GameLog) pubsub.Acktype {
-	return func(gamelog routing.GameLog) pubsub.Acktype {
-		defer fmt.Print("> ")
-		err := gamelogic.WriteLog(gamelog)
+func handlerLog() func(pubsub.Delivery[routing.GameLog]) pubsub.Acktype {
+	return func(d pubsub.Delivery[routing.GameLog]) pubsub.Acktype {
+		err := gamelogic.WriteLog(d.Body)
 		if err != nil {
-			return pubsub.NackRequeue
+			return pubsub.NackRetry
 		}
 
 		return pubsub.Ack
 	}
 }
+
+func handlerPlayingState(games *gamelogic.Games) func(context.Context, string) (routing.PlayingState, error) {
+	return func(_ context.Context, gameID string) (routing.PlayingState, error) {
+		world, err := games.World(gameID)
+		if err != nil {
+			return routing.PlayingState{}, err
+		}
+		return routing.PlayingState{IsPaused: world.Paused()}, nil
+	}
+}
+
+func handlerSpawn(games *gamelogic.Games) func(context.Context, gamelogic.SpawnRequest) (gamelogic.Unit, error) {
+	return func(_ context.Context, req gamelogic.SpawnRequest) (gamelogic.Unit, error) {
+		world, err := games.World(req.GameID)
+		if err != nil {
+			return gamelogic.Unit{}, err
+		}
+		return world.Spawn(req)
+	}
+}
+
+func handlerPlayer(games *gamelogic.Games) func(context.Context, gamelogic.PlayerRequest) (gamelogic.Player, error) {
+	return func(_ context.Context, req gamelogic.PlayerRequest) (gamelogic.Player, error) {
+		world, err := games.World(req.GameID)
+		if err != nil {
+			return gamelogic.Player{}, err
+		}
+		return world.Player(req.Username), nil
+	}
+}
+
+// handlerMove moves the units and announces the move and the wars it started
+// to the game's players, and logs the wars, all together or not at all: the
+// world only changes once the announcements are in the outbox. Each war
+// result is sealed for the two players who fought.
+func handlerMove(games *gamelogic.Games, outbox *pubsub.Outbox, sealKeys *pubsub.SealKeys) func(context.Context, gamelogic.MoveRequest) (gamelogic.ArmyMove, error) {
+	return func(_ context.Context, req gamelogic.MoveRequest) (gamelogic.ArmyMove, error) {
+		world, err := games.World(req.GameID)
+		if err != nil {
+			return gamelogic.ArmyMove{}, err
+		}
+		return world.Move(req, func(move gamelogic.ArmyMove, wars []gamelogic.WarResult) error {
+			return outbox.Transaction(func(tx pubsub.Publisher) error {
+				if err := pubsub.PublishJSON(tx, routing.ExchangePerilTopic, routing.GameKey(routing.ArmyMovesPrefix, req.GameID, req.Username), move); err != nil {
+					return err
+				}
+				for _, war := range wars {
+					for _, username := range []string{war.Attacker, war.Defender} {
+						codec, err := sealKeys.Sealed(pubsub.JSON, routing.PlayerIdentity(req.GameID, username))
+						if err != nil {
+							return err
+						}
+						if err := pubsub.Publish(tx, codec, routing.ExchangePerilTopic, routing.GameKey(routing.WarRecognitionsPrefix, req.GameID, username), war); err != nil {
+							return err
+						}
+					}
+					msg := fmt.Sprintf("%s won a war against %s", war.Winner, war.Loser)
+					if war.Draw {
+						msg = fmt.Sprintf("A war between %s and %s resulted in a draw", war.Attacker, war.Defender)
+					}
+					gl := routing.GameLog{
+						CurrentTime: time.Now(),
+						GameID:      req.GameID,
+						Message:     msg,
+						Username:    war.Attacker,
+					}
+					if err := pubsub.PublishJSON(tx, routing.ExchangePerilTopic, routing.GameKey(routing.GameLogSlug, req.GameID, war.Attacker), gl); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// handlerRegister reserves a username in a game, see Lobby.Register, and
+// hands the player a fresh key to sign its messages with. Whoever registered
+// the username last is the only one who can speak for it, and while they
+// are online only the player holding its token can register it again.
+func handlerRegister(games *gamelogic.Games, lobby *gamelogic.Lobby, keys *pubsub.Keyring, sealKeys *pubsub.SealKeys, serverKey ed25519.PublicKey, channel pubsub.Publisher) func(context.Context, gamelogic.PlayerRequest) (gamelogic.Registration, error) {
+	return func(_ context.Context, req gamelogic.PlayerRequest) (gamelogic.Registration, error) {
+		if !routing.ValidName(req.Username) {
+			return gamelogic.Registration{}, fmt.Errorf("%q is not a valid username, use 1 to 32 letters, digits, dashes or underscores", req.Username)
+		}
+		if _, err := games.World(req.GameID); err != nil {
+			return gamelogic.Registration{}, err
+		}
+		public, private, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return gamelogic.Registration{}, err
+		}
+		token, err := lobby.Register(req.GameID, req.Username, req.Token, time.Now())
+		if err != nil {
+			return gamelogic.Registration{}, err
+		}
+		sealKey := pubsub.NewSealKey()
+		if err := sealKeys.Add(req.Sender(), sealKey); err != nil {
+			return gamelogic.Registration{}, err
+		}
+		keys.Add(req.Sender(), public)
+		fmt.Printf("%s joined %s.\n", req.Username, req.GameID)
+		if err := announcePresence(channel, req.GameID, req.Username, routing.PresenceJoin); err != nil {
+			fmt.Println(err)
+		}
+		return gamelogic.Registration{Key: private, ServerKey: serverKey, SealKey: sealKey, Token: token}, nil
+	}
+}
+
+// handlerPresence keeps the lobby up to date and tells a game's players who
+// joined and who left it.
+func handlerPresence(games *gamelogic.Games, lobby *gamelogic.Lobby, channel pubsub.Publisher) func(routing.Presence) pubsub.Acktype {
+	return func(p routing.Presence) pubsub.Acktype {
+		// Players of a closed game go on sending heartbeats until they quit.
+		if _, err := games.World(p.GameID); err != nil {
+			return pubsub.NackDiscard
+		}
+		status, changed := lobby.Update(p, time.Now())
+		if !changed {
+			return pubsub.Ack
+		}
+		if status == routing.PresenceJoin {
+			fmt.Printf("%s joined %s.\n", p.Username, p.GameID)
+		} else {
+			fmt.Printf("%s left %s.\n", p.Username, p.GameID)
+		}
+		// The lobby has moved on already, so retrying wouldn't announce
+		// anything; the players just miss this notice.
+		if err := announcePresence(channel, p.GameID, p.Username, status); err != nil {
+			fmt.Println(err)
+		}
+		return pubsub.Ack
+	}
+}
+
+// announcePresence tells everybody in a game that username joined, left or
+// dropped.
+func announcePresence(channel pubsub.Publisher, gameID, username string, status routing.PresenceStatus) error {
+	return pubsub.PublishJSON(channel, routing.ExchangePerilTopic, routing.GameKey(routing.LobbyPrefix, gameID, username), routing.Presence{
+		GameID:   gameID,
+		Username: username,
+		Status:   status,
+		Time:     time.Now(),
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func newSigner(t *testing.T, keys *pubsub.Keyring, identity string) pubsub.Signer {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.Add(identity, public)
+	return pubsub.Signer{Identity: identity, Key: private}
+}
+
+func TestLogsSignedByServerOrAuthor(t *testing.T) {
+	broker := pubsub.NewMemoryBroker()
+	conn := broker.Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(routing.ExchangePerilTopic, pubsub.ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := pubsub.NewKeyring()
+	server := newSigner(t, keys, routing.ServerIdentity)
+	alice := newSigner(t, keys, routing.PlayerIdentity("g1", "alice"))
+	bob := newSigner(t, keys, routing.PlayerIdentity("g1", "bob"))
+
+	handled := make(chan string, 3)
+	sub, err := pubsub.SubscribeDelivery(context.Background(), conn, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameKey(routing.GameLogSlug, "*", "*"), pubsub.SimpleQueueTypeTransient,
+		pubsub.Chain(pubsub.BodyHandler(func(gl routing.GameLog) pubsub.Acktype {
+			handled <- gl.Message
+			return pubsub.Ack
+		}), pubsub.VerifyAny(keys, routing.GameLog.Senders)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	publish := func(signer pubsub.Signer, message string) {
+		t.Helper()
+		gl := routing.GameLog{CurrentTime: time.Now(), GameID: "g1", Username: "alice", Message: message}
+		if err := pubsub.PublishJSON(pubsub.SignAll(ch, signer), routing.ExchangePerilTopic, routing.GameKey(routing.GameLogSlug, "g1", "alice"), gl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(bob, "forged by bob")
+	publish(server, "alice won a war against bob")
+	publish(alice, "alice is spamming")
+
+	for _, want := range []string{"alice won a war against bob", "alice is spamming"} {
+		select {
+		case got := <-handled:
+			if got != want {
+				t.Errorf("handled %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q was not handled", want)
+		}
+	}
+	select {
+	case got := <-handled:
+		t.Errorf("handled %q too", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestMoveChangesNothingUnlessAnnounced(t *testing.T) {
+	conn := pubsub.NewMemoryBroker().Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := pubsub.OpenOutbox(filepath.Join(t.TempDir(), "outbox"), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealKeys := pubsub.NewSealKeys()
+	games := gamelogic.NewGames()
+	world, err := games.Create("g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err := sealKeys.Add(routing.PlayerIdentity("g1", username), pubsub.NewSealKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attacker, err := world.Spawn(gamelogic.SpawnRequest{GameID: "g1", Username: "alice", Location: "americas", Rank: "artillery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := world.Spawn(gamelogic.SpawnRequest{GameID: "g1", Username: "bob", Location: "europe", Rank: "infantry"}); err != nil {
+		t.Fatal(err)
+	}
+	move := handlerMove(games, outbox, sealKeys)
+	req := gamelogic.MoveRequest{GameID: "g1", Username: "alice", ToLocation: "europe", UnitIDs: []int{attacker.ID}}
+
+	// A closed outbox can't record anything, like one whose disk is full.
+	outbox.Close()
+	if _, err := move(context.Background(), req); err == nil {
+		t.Fatal("move succeeded without an outbox")
+	}
+	if u := world.Player("alice").Units[attacker.ID]; u.Location != "americas" {
+		t.Errorf("alice's unit moved to %s although the move was never announced", u.Location)
+	}
+	if units := world.Player("bob").Units; len(units) != 1 {
+		t.Errorf("bob has %d units left after a war nobody heard of, want 1", len(units))
+	}
+
+	outbox, err = pubsub.OpenOutbox(filepath.Join(t.TempDir(), "outbox"), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	if _, err := handlerMove(games, outbox, sealKeys)(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if u := world.Player("alice").Units[attacker.ID]; u.Location != "europe" {
+		t.Errorf("alice's unit is in %s after moving to europe", u.Location)
+	}
+	if units := world.Player("bob").Units; len(units) != 0 {
+		t.Errorf("bob has %d units left after losing a war, want none", len(units))
+	}
+}
+
+func TestMoveAnnouncesOnlyMovedUnits(t *testing.T) {
+	conn := pubsub.NewMemoryBroker().Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(routing.ExchangePerilTopic, pubsub.ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := pubsub.OpenOutbox(filepath.Join(t.TempDir(), "outbox"), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	games := gamelogic.NewGames()
+	world, err := games.Create("g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var units []gamelogic.Unit
+	for _, loc := range []gamelogic.Location{"americas", "asia"} {
+		u, err := world.Spawn(gamelogic.SpawnRequest{GameID: "g1", Username: "alice", Location: loc, Rank: "infantry"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		units = append(units, u)
+	}
+
+	announced := make(chan gamelogic.ArmyMove, 1)
+	sub, err := pubsub.SubscribeJSON(context.Background(), conn, routing.ExchangePerilTopic, "army_moves.g1.bob", routing.GameKey(routing.ArmyMovesPrefix, "g1", "*"), pubsub.SimpleQueueTypeTransient,
+		func(move gamelogic.ArmyMove) pubsub.Acktype {
+			announced <- move
+			return pubsub.Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	req := gamelogic.MoveRequest{GameID: "g1", Username: "alice", ToLocation: "europe", UnitIDs: []int{units[0].ID}}
+	if _, err := handlerMove(games, outbox, pubsub.NewSealKeys())(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case move := <-announced:
+		if move.Player.Username != "alice" || len(move.Player.Units) != 0 {
+			t.Errorf("announced %+v with alice's units, want only her name", move.Player)
+		}
+		if len(move.Units) != 1 || move.Units[0].ID != units[0].ID || move.ToLocation != "europe" {
+			t.Errorf("announced %v to %s, want the moved unit to europe", move.Units, move.ToLocation)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the move was never announced")
+	}
+}
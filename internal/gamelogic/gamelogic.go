@@ -7,6 +7,9 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
 func PrintClientHelp() {
@@ -29,6 +32,10 @@ func ClientWelcome() (string, error) {
 	fmt.Println("Welcome to the Peril client!")
 	fmt.Println("Please enter your username:")
 	words := GetInput()
+	for len(words) > 0 && !routing.ValidName(words[0]) {
+		fmt.Println("Usernames are 1 to 32 letters, digits, dashes or underscores. Please try again:")
+		words = GetInput()
+	}
 	if len(words) == 0 {
 		return "", errors.New("you must enter a username. goodbye")
 	}
@@ -38,10 +45,30 @@ func ClientWelcome() (string, error) {
 	return username, nil
 }
 
+// ClientChooseGame asks which game to join.
+func ClientChooseGame() (string, error) {
+	fmt.Println("Which game do you want to join?")
+	words := GetInput()
+	for len(words) > 0 && !routing.ValidName(words[0]) {
+		fmt.Println("Game IDs are 1 to 32 letters, digits, dashes or underscores. Please try again:")
+		words = GetInput()
+	}
+	if len(words) == 0 {
+		return "", errors.New("you must enter a game. goodbye")
+	}
+	return words[0], nil
+}
+
 func PrintServerHelp() {
 	fmt.Println("Possible commands:")
-	fmt.Println("* pause")
-	fmt.Println("* resume")
+	fmt.Println("* new <game>")
+	fmt.Println("    example:")
+	fmt.Println("    new europe-1")
+	fmt.Println("* games")
+	fmt.Println("* players")
+	fmt.Println("* pause <game>")
+	fmt.Println("* resume <game>")
+	fmt.Println("* close <game>")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -58,6 +85,33 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
+// GetInputs reads commands in the background so callers can wait for input
+// and for other events (like a shutdown signal) at the same time. The channel
+// is closed when stdin is closed.
+func GetInputs() <-chan []string {
+	inputs := make(chan []string)
+	go func() {
+		defer close(inputs)
+		for {
+			words := GetInput()
+			if words == nil {
+				return
+			}
+			inputs <- words
+		}
+	}()
+	return inputs
+}
+
+// RedrawPrompt prints the REPL prompt again after a handler has written over
+// it.
+func RedrawPrompt[T any](next pubsub.Handler[T]) pubsub.Handler[T] {
+	return func(d pubsub.Delivery[T]) pubsub.Acktype {
+		defer fmt.Print("> ")
+		return next(d)
+	}
+}
+
 func GetMaliciousLog() string {
 	possibleLogs := []string{
 		"Never interrupt your enemy when he is making a mistake.",
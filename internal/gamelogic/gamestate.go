@@ -1,6 +1,8 @@
 package gamelogic
 
 import (
+	"io"
+	"os"
 	"sync"
 )
 
@@ -8,6 +10,8 @@ type GameState struct {
 	Player Player
 	Paused bool
 	mu     *sync.RWMutex
+	// out is where the state describes what happens to the player.
+	out io.Writer
 }
 
 func NewGameState(username string) *GameState {
@@ -18,9 +22,17 @@ func NewGameState(username string) *GameState {
 		},
 		Paused: false,
 		mu:     &sync.RWMutex{},
+		out:    os.Stdout,
 	}
 }
 
+// SetOutput makes the state describe what happens to the player on w instead
+// of stdout, e.g. io.Discard when there is no terminal to print on. Call it
+// before the state is shared.
+func (gs *GameState) SetOutput(w io.Writer) {
+	gs.out = w
+}
+
 func (gs *GameState) resumeGame() {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
@@ -94,3 +106,11 @@ func (gs *GameState) GetPlayerSnap() Player {
 		Units:    Units,
 	}
 }
+
+func (gs *GameState) removeUnits(ids []int) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, id := range ids {
+		delete(gs.Player.Units, id)
+	}
+}
@@ -0,0 +1,24 @@
+package gamelogic
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSetOutput(t *testing.T) {
+	gs := NewGameState("bob")
+	var out bytes.Buffer
+	gs.SetOutput(&out)
+	gs.ApplySpawn(Unit{ID: 1, Rank: RankInfantry, Location: "europe"})
+
+	move := ArmyMove{Player: Player{Username: "alice"}, Units: []Unit{{ID: 7, Rank: RankArtillery, Location: "europe"}}, ToLocation: "europe"}
+	if outcome := gs.HandleMove(move); outcome != MoveOutcomeMakeWar {
+		t.Errorf("alice moving into europe: got outcome %v, want war", outcome)
+	}
+	for _, want := range []string{"Spawned a(n) infantry in europe", "alice is moving 1 unit(s) to europe", "You are at war with alice"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q is missing %q", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package gamelogic
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// PlayerPresence is what the server knows about a player's connection.
+type PlayerPresence struct {
+	GameID   string
+	Username string
+	Online   bool
+	LastSeen time.Time
+}
+
+// Lobby keeps track of who is playing which game, from the players' join,
+// heartbeat and leave messages.
+type Lobby struct {
+	mu      sync.Mutex
+	players map[lobbyKey]*PlayerPresence
+	// tokens are what an online player has to show to register their
+	// username again. They go when the player does.
+	tokens map[lobbyKey]string
+}
+
+type lobbyKey struct {
+	gameID   string
+	username string
+}
+
+func NewLobby() *Lobby {
+	return &Lobby{
+		players: map[lobbyKey]*PlayerPresence{},
+		tokens:  map[lobbyKey]string{},
+	}
+}
+
+// Register reserves username in a game for a player joining it, and marks
+// them online. A username is taken while its player is online: until they
+// leave or miss their heartbeats, which releases it for anybody. Register
+// hands the player a fresh token, which lets them register the username
+// again before that, e.g. after losing their connection; it returns the
+// token.
+func (l *Lobby) Register(gameID, username, token string, now time.Time) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := lobbyKey{gameID, username}
+	want, claimed := l.tokens[key]
+	pp, ok := l.players[key]
+	if ok && pp.Online && (!claimed || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1) {
+		return "", fmt.Errorf("%s is already playing in %s, pick another username", username, gameID)
+	}
+	if !claimed {
+		want = newToken()
+		l.tokens[key] = want
+	}
+	if !ok {
+		pp = &PlayerPresence{GameID: gameID, Username: username}
+		l.players[key] = pp
+	}
+	pp.Online = true
+	pp.LastSeen = now
+	return want, nil
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Update records p, received at now. It returns what the game's players
+// should be told, if anything: a heartbeat from a player we thought was
+// gone (a server restart forgets everybody) counts as a join.
+func (l *Lobby) Update(p routing.Presence, now time.Time) (routing.PresenceStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := lobbyKey{p.GameID, p.Username}
+	pp, ok := l.players[key]
+	if !ok {
+		pp = &PlayerPresence{GameID: p.GameID, Username: p.Username}
+		l.players[key] = pp
+	}
+	pp.LastSeen = now
+
+	wasOnline := pp.Online
+	pp.Online = p.Status != routing.PresenceLeave
+	if !pp.Online {
+		delete(l.tokens, key)
+	}
+	switch {
+	case pp.Online && !wasOnline:
+		return routing.PresenceJoin, true
+	case !pp.Online && wasOnline:
+		return routing.PresenceLeave, true
+	}
+	return "", false
+}
+
+// Expire marks the players not seen for timeout offline, releasing their
+// usernames, and returns them.
+func (l *Lobby) Expire(now time.Time, timeout time.Duration) []PlayerPresence {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var dropped []PlayerPresence
+	for key, pp := range l.players {
+		if pp.Online && now.Sub(pp.LastSeen) > timeout {
+			pp.Online = false
+			delete(l.tokens, key)
+			dropped = append(dropped, *pp)
+		}
+	}
+	sortPresences(dropped)
+	return dropped
+}
+
+// Forget drops everything known about a game's players.
+func (l *Lobby) Forget(gameID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key := range l.players {
+		if key.gameID == gameID {
+			delete(l.players, key)
+		}
+	}
+	for key := range l.tokens {
+		if key.gameID == gameID {
+			delete(l.tokens, key)
+		}
+	}
+}
+
+// List returns every player the lobby has seen, by game and username.
+func (l *Lobby) List() []PlayerPresence {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]PlayerPresence, 0, len(l.players))
+	for _, pp := range l.players {
+		list = append(list, *pp)
+	}
+	sortPresences(list)
+	return list
+}
+
+func sortPresences(list []PlayerPresence) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].GameID != list[j].GameID {
+			return list[i].GameID < list[j].GameID
+		}
+		return list[i].Username < list[j].Username
+	})
+}
@@ -0,0 +1,134 @@
+package gamelogic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRegisterHoldsNameWhileOnline(t *testing.T) {
+	l := NewLobby()
+	now := time.Now()
+	token, err := l.Register("g1", "alice", "", now)
+	if err != nil || token == "" {
+		t.Fatalf("registering alice: token %q, %v", token, err)
+	}
+
+	for _, wrong := range []string{"", "not-alices-token"} {
+		if _, err := l.Register("g1", "alice", wrong, now); err == nil {
+			t.Errorf("registered alice with token %q while she plays", wrong)
+		}
+	}
+	// Her own token takes the name back, e.g. after losing the connection.
+	if again, err := l.Register("g1", "alice", token, now); err != nil || again != token {
+		t.Errorf("alice coming back with her token: token %q, %v", again, err)
+	}
+	// Names are per game.
+	if _, err := l.Register("g2", "alice", "", now); err != nil {
+		t.Errorf("registering alice in another game: %s", err)
+	}
+}
+
+func TestLeavingReleasesName(t *testing.T) {
+	l := NewLobby()
+	now := time.Now()
+	token, err := l.Register("g1", "alice", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Update(routing.Presence{GameID: "g1", Username: "alice", Status: routing.PresenceLeave}, now)
+
+	taken, err := l.Register("g1", "alice", "", now)
+	if err != nil {
+		t.Fatalf("registering alice after she left: %s", err)
+	}
+	if taken == token {
+		t.Error("the new alice got the old alice's token")
+	}
+	if _, err := l.Register("g1", "alice", token, now); err == nil {
+		t.Error("the old alice's token took the name back from the new one")
+	}
+}
+
+func TestExpiryReleasesName(t *testing.T) {
+	l := NewLobby()
+	now := time.Now()
+	token, err := l.Register("g1", "alice", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped := l.Expire(now.Add(time.Minute), 30*time.Second); len(dropped) != 1 || dropped[0].Username != "alice" {
+		t.Fatalf("dropped %+v, want alice", dropped)
+	}
+
+	taken, err := l.Register("g1", "alice", "", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("registering alice after her heartbeats stopped: %s", err)
+	}
+	if taken == token {
+		t.Error("the new alice got the old alice's token")
+	}
+}
+
+func TestUpdateAnnouncesComingsAndGoings(t *testing.T) {
+	l := NewLobby()
+	now := time.Now()
+	presence := func(status routing.PresenceStatus) routing.Presence {
+		return routing.Presence{GameID: "g1", Username: "alice", Status: status}
+	}
+	for _, tt := range []struct {
+		status   routing.PresenceStatus
+		announce routing.PresenceStatus
+	}{
+		{routing.PresenceJoin, routing.PresenceJoin},
+		{routing.PresenceHeartbeat, ""},
+		{routing.PresenceJoin, ""},
+		{routing.PresenceLeave, routing.PresenceLeave},
+		{routing.PresenceLeave, ""},
+		// A heartbeat from somebody we thought was gone, e.g. after a
+		// server restart, is a join.
+		{routing.PresenceHeartbeat, routing.PresenceJoin},
+	} {
+		got, ok := l.Update(presence(tt.status), now)
+		if ok != (tt.announce != "") || got != tt.announce {
+			t.Errorf("%s: announced %q (%v), want %q", tt.status, got, ok, tt.announce)
+		}
+	}
+}
+
+func TestExpireDropsSilentPlayers(t *testing.T) {
+	l := NewLobby()
+	start := time.Now()
+	for _, username := range []string{"bob", "alice", "carol"} {
+		l.Update(routing.Presence{GameID: "g1", Username: username, Status: routing.PresenceJoin}, start)
+	}
+	l.Update(routing.Presence{GameID: "g1", Username: "carol", Status: routing.PresenceLeave}, start)
+	// Only bob keeps sending heartbeats.
+	l.Update(routing.Presence{GameID: "g1", Username: "bob", Status: routing.PresenceHeartbeat}, start.Add(20*time.Second))
+
+	if dropped := l.Expire(start.Add(10*time.Second), 15*time.Second); len(dropped) != 0 {
+		t.Errorf("dropped %+v before the timeout", dropped)
+	}
+	dropped := l.Expire(start.Add(30*time.Second), 15*time.Second)
+	if len(dropped) != 1 || dropped[0].Username != "alice" || dropped[0].Online {
+		t.Fatalf("dropped %+v, want alice and only alice", dropped)
+	}
+	if again := l.Expire(start.Add(time.Minute), 15*time.Second); len(again) != 1 || again[0].Username != "bob" {
+		t.Errorf("later dropped %+v, want bob, and alice only once", again)
+	}
+
+	var online []string
+	for _, pp := range l.List() {
+		if pp.Online {
+			online = append(online, pp.Username)
+		}
+	}
+	if len(online) != 0 || len(l.List()) != 3 {
+		t.Errorf("%v still online out of %+v", online, l.List())
+	}
+	l.Forget("g1")
+	if list := l.List(); len(list) != 0 {
+		t.Errorf("%+v left after forgetting the game", list)
+	}
+}
@@ -15,26 +15,32 @@ const (
 )
 
 func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
-	defer fmt.Println("------------------------")
+	defer fmt.Fprintln(gs.out, "------------------------")
 	player := gs.GetPlayerSnap()
 
-	fmt.Println()
-	fmt.Println("==== Move Detected ====")
-	fmt.Printf("%s is moving %v unit(s) to %s\n", move.Player.Username, len(move.Units), move.ToLocation)
+	fmt.Fprintln(gs.out)
+	fmt.Fprintln(gs.out, "==== Move Detected ====")
+	fmt.Fprintf(gs.out, "%s is moving %v unit(s) to %s\n", move.Player.Username, len(move.Units), move.ToLocation)
 	for _, unit := range move.Units {
-		fmt.Printf("* %v\n", unit.Rank)
+		fmt.Fprintf(gs.out, "* %v\n", unit.Rank)
 	}
 
 	if player.Username == move.Player.Username {
 		return MoveOutcomeSamePlayer
 	}
 
-	overlappingLocation := getOverlappingLocation(player, move.Player)
+	// The server only announces the moved units, so they are all a war can
+	// start with.
+	moved := Player{Username: move.Player.Username, Units: map[int]Unit{}}
+	for _, unit := range move.Units {
+		moved.Units[unit.ID] = unit
+	}
+	overlappingLocation := getOverlappingLocation(player, moved)
 	if overlappingLocation != "" {
-		fmt.Printf("You have units in %s! You are at war with %s!\n", overlappingLocation, move.Player.Username)
+		fmt.Fprintf(gs.out, "You have units in %s! You are at war with %s!\n", overlappingLocation, move.Player.Username)
 		return MoveOutcomeMakeWar
 	}
-	fmt.Printf("You are safe from %s's units.\n", move.Player.Username)
+	fmt.Fprintf(gs.out, "You are safe from %s's units.\n", move.Player.Username)
 	return MoveOutComeSafe
 }
 
@@ -87,6 +93,14 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		Units:      newUnits,
 		Player:     gs.GetPlayerSnap(),
 	}
-	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
+	fmt.Fprintf(gs.out, "Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
 	return mv, nil
 }
+
+// ApplyMove moves the player's units once the server has accepted the move.
+func (gs *GameState) ApplyMove(move ArmyMove) {
+	for _, unit := range move.Units {
+		gs.UpdateUnit(unit)
+	}
+	fmt.Fprintf(gs.out, "Moved %v units to %s\n", len(move.Units), move.ToLocation)
+}
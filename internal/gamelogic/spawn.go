@@ -29,6 +29,12 @@ func (gs *GameState) CommandSpawn(words []string) error {
 		Location: Location(locationName),
 	})
 
-	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
+	fmt.Fprintf(gs.out, "Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
 	return nil
 }
+
+// ApplySpawn adds a unit the server spawned for the player.
+func (gs *GameState) ApplySpawn(u Unit) {
+	gs.addUnit(u)
+	fmt.Fprintf(gs.out, "Spawned a(n) %s in %s with id %v\n", u.Rank, u.Location, u.ID)
+}
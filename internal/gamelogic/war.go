@@ -15,26 +15,26 @@ const (
 )
 
 func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
-	defer fmt.Println("------------------------")
-	fmt.Println()
-	fmt.Println("==== War Declared ====")
-	fmt.Printf("%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
+	defer fmt.Fprintln(gs.out, "------------------------")
+	fmt.Fprintln(gs.out)
+	fmt.Fprintln(gs.out, "==== War Declared ====")
+	fmt.Fprintf(gs.out, "%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
 
 	player := gs.GetPlayerSnap()
 
 	if player.Username == rw.Defender.Username {
-		fmt.Printf("%s, you published the war.\n", player.Username)
+		fmt.Fprintf(gs.out, "%s, you published the war.\n", player.Username)
 		return WarOutcomeNotInvolved, "", ""
 	}
 
 	if player.Username != rw.Attacker.Username {
-		fmt.Printf("%s, you are not involved in this war.\n", player.Username)
+		fmt.Fprintf(gs.out, "%s, you are not involved in this war.\n", player.Username)
 		return WarOutcomeNotInvolved, "", ""
 	}
 
 	overlappingLocation := getOverlappingLocation(rw.Attacker, rw.Defender)
 	if overlappingLocation == "" {
-		fmt.Printf("Error! No units are in the same location. No war will be fought.\n")
+		fmt.Fprintf(gs.out, "Error! No units are in the same location. No war will be fought.\n")
 		return WarOutcomeNoUnits, "", ""
 	}
 
@@ -51,43 +51,76 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 		}
 	}
 
-	fmt.Printf("%s's units:\n", rw.Attacker.Username)
+	fmt.Fprintf(gs.out, "%s's units:\n", rw.Attacker.Username)
 	for _, unit := range attackerUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
+		fmt.Fprintf(gs.out, "  * %v\n", unit.Rank)
 	}
-	fmt.Printf("%s's units:\n", rw.Defender.Username)
+	fmt.Fprintf(gs.out, "%s's units:\n", rw.Defender.Username)
 	for _, unit := range defenderUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
+		fmt.Fprintf(gs.out, "  * %v\n", unit.Rank)
 	}
 	attackerPower := unitsToPowerLevel(attackerUnits)
 	defenderPower := unitsToPowerLevel(defenderUnits)
-	fmt.Printf("Attacker has a power level of %v\n", attackerPower)
-	fmt.Printf("Defender has a power level of %v\n", defenderPower)
+	fmt.Fprintf(gs.out, "Attacker has a power level of %v\n", attackerPower)
+	fmt.Fprintf(gs.out, "Defender has a power level of %v\n", defenderPower)
 	if attackerPower > defenderPower {
-		fmt.Printf("%s has won the war!\n", rw.Attacker.Username)
+		fmt.Fprintf(gs.out, "%s has won the war!\n", rw.Attacker.Username)
 		if player.Username == rw.Defender.Username {
-			fmt.Println("You have lost the war!")
+			fmt.Fprintln(gs.out, "You have lost the war!")
 			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
+			fmt.Fprintf(gs.out, "Your units in %s have been killed.\n", overlappingLocation)
 			return WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username
 		}
 		return WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username
 	} else if defenderPower > attackerPower {
-		fmt.Printf("%s has won the war!\n", rw.Defender.Username)
+		fmt.Fprintf(gs.out, "%s has won the war!\n", rw.Defender.Username)
 		if player.Username == rw.Attacker.Username {
-			fmt.Println("You have lost the war!")
+			fmt.Fprintln(gs.out, "You have lost the war!")
 			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
+			fmt.Fprintf(gs.out, "Your units in %s have been killed.\n", overlappingLocation)
 			return WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username
 		}
 		return WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username
 	}
-	fmt.Println("The war ended in a draw!")
-	fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
+	fmt.Fprintln(gs.out, "The war ended in a draw!")
+	fmt.Fprintf(gs.out, "Your units in %s have been killed.\n", overlappingLocation)
 	gs.removeUnitsInLocation(overlappingLocation)
 	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
 }
 
+// HandleWarResult shows a war the server fought and removes the player's
+// units that died in it.
+func (gs *GameState) HandleWarResult(r WarResult) WarOutcome {
+	defer fmt.Fprintln(gs.out, "------------------------")
+	fmt.Fprintln(gs.out)
+	fmt.Fprintln(gs.out, "==== War Declared ====")
+	fmt.Fprintf(gs.out, "%s has declared war on %s in %s!\n", r.Attacker, r.Defender, r.Location)
+
+	username := gs.GetUsername()
+	if username != r.Attacker && username != r.Defender {
+		fmt.Fprintf(gs.out, "%s, you are not involved in this war.\n", username)
+		return WarOutcomeNotInvolved
+	}
+
+	fmt.Fprintf(gs.out, "Attacker has a power level of %v\n", r.AttackerPower)
+	fmt.Fprintf(gs.out, "Defender has a power level of %v\n", r.DefenderPower)
+	if killed := r.Killed[username]; len(killed) > 0 {
+		gs.removeUnits(killed)
+		fmt.Fprintf(gs.out, "Your units in %s have been killed.\n", r.Location)
+	}
+	switch {
+	case r.Draw:
+		fmt.Fprintln(gs.out, "The war ended in a draw!")
+		return WarOutcomeDraw
+	case r.Winner == username:
+		fmt.Fprintln(gs.out, "You have won the war!")
+		return WarOutcomeYouWon
+	default:
+		fmt.Fprintln(gs.out, "You have lost the war!")
+		return WarOutcomeOpponentWon
+	}
+}
+
 func unitsToPowerLevel(units []Unit) int {
 	power := 0
 	for _, unit := range units {
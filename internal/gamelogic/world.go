@@ -0,0 +1,386 @@
+package gamelogic
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// SpawnRequest asks the server for a new unit. The answer is the Unit.
+type SpawnRequest struct {
+	GameID   string
+	Username string
+	Location Location
+	Rank     UnitRank
+}
+
+// MoveRequest asks the server to move units. The answer is the ArmyMove.
+type MoveRequest struct {
+	GameID     string
+	Username   string
+	ToLocation Location
+	UnitIDs    []int
+}
+
+// PlayerRequest asks the server for a player's units in a game. The answer
+// is the Player. Registering a username the player still holds, e.g. after
+// losing their connection, takes the Token they were given then.
+type PlayerRequest struct {
+	GameID   string
+	Username string
+	Token    string
+}
+
+// Registration is the answer to a PlayerRequest registering a username: the
+// key the player signs its messages with, the key the server signs its own
+// with, the key that opens messages sealed for the player, and the token to
+// register the username again with while it is theirs.
+type Registration struct {
+	Key       ed25519.PrivateKey
+	ServerKey ed25519.PublicKey
+	SealKey   []byte
+	Token     string
+}
+
+// Sender is who has to have signed the request.
+func (req SpawnRequest) Sender() string {
+	return routing.PlayerIdentity(req.GameID, req.Username)
+}
+
+func (req MoveRequest) Sender() string {
+	return routing.PlayerIdentity(req.GameID, req.Username)
+}
+
+func (req PlayerRequest) Sender() string {
+	return routing.PlayerIdentity(req.GameID, req.Username)
+}
+
+// WarResult is the server's verdict on a war: who fought where, who won and
+// which units died. Winner and Loser are empty after a draw.
+type WarResult struct {
+	Attacker      string
+	Defender      string
+	Location      Location
+	AttackerPower int
+	DefenderPower int
+	Winner        string
+	Loser         string
+	Draw          bool
+	// Killed lists the IDs of the units that died, by player.
+	Killed map[string][]int
+}
+
+// NewSpawnRequest parses "spawn <location> <rank>".
+func NewSpawnRequest(gameID, username string, words []string) (SpawnRequest, error) {
+	if len(words) < 3 {
+		return SpawnRequest{}, errors.New("usage: spawn <location> <rank>")
+	}
+	req := SpawnRequest{
+		GameID:   gameID,
+		Username: username,
+		Location: Location(words[1]),
+		Rank:     UnitRank(words[2]),
+	}
+	return req, req.validate()
+}
+
+func (req SpawnRequest) validate() error {
+	if _, ok := getAllLocations()[req.Location]; !ok {
+		return fmt.Errorf("error: %s is not a valid location", req.Location)
+	}
+	if _, ok := getAllRanks()[req.Rank]; !ok {
+		return fmt.Errorf("error: %s is not a valid unit", req.Rank)
+	}
+	return nil
+}
+
+// NewMoveRequest parses "move <location> <unitID> <unitID>...".
+func NewMoveRequest(gameID, username string, words []string) (MoveRequest, error) {
+	if len(words) < 3 {
+		return MoveRequest{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
+	}
+	req := MoveRequest{
+		GameID:     gameID,
+		Username:   username,
+		ToLocation: Location(words[1]),
+	}
+	for _, word := range words[2:] {
+		id, err := strconv.Atoi(word)
+		if err != nil {
+			return MoveRequest{}, fmt.Errorf("error: %s is not a valid unit ID", word)
+		}
+		req.UnitIDs = append(req.UnitIDs, id)
+	}
+	return req, req.validate()
+}
+
+func (req MoveRequest) validate() error {
+	if _, ok := getAllLocations()[req.ToLocation]; !ok {
+		return fmt.Errorf("error: %s is not a valid location", req.ToLocation)
+	}
+	if len(req.UnitIDs) == 0 {
+		return errors.New("error: no units to move")
+	}
+	return nil
+}
+
+// Games holds the world of every game a server runs, by game ID.
+type Games struct {
+	mu     sync.Mutex
+	worlds map[string]*World
+}
+
+func NewGames() *Games {
+	return &Games{worlds: map[string]*World{}}
+}
+
+// Create starts a new game with nobody in it.
+func (g *Games) Create(gameID string) (*World, error) {
+	if !routing.ValidName(gameID) {
+		return nil, fmt.Errorf("error: %q is not a valid game ID, use 1 to 32 letters, digits, dashes or underscores", gameID)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.worlds[gameID]; ok {
+		return nil, fmt.Errorf("error: game %s already exists", gameID)
+	}
+	w := NewWorld()
+	g.worlds[gameID] = w
+	return w, nil
+}
+
+func (g *Games) World(gameID string) (*World, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	w, ok := g.worlds[gameID]
+	if !ok {
+		return nil, fmt.Errorf("error: there is no game %s", gameID)
+	}
+	return w, nil
+}
+
+// Close ends a game. Its world is forgotten, so every later request for it
+// fails.
+func (g *Games) Close(gameID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.worlds[gameID]; !ok {
+		return fmt.Errorf("error: there is no game %s", gameID)
+	}
+	delete(g.worlds, gameID)
+	return nil
+}
+
+// List returns the IDs of the running games, sorted.
+func (g *Games) List() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]string, 0, len(g.worlds))
+	for id := range g.worlds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// World is the server's authoritative picture of one game: every player's
+// units and whether the game is paused. Clients only ever see copies of it.
+type World struct {
+	mu      sync.Mutex
+	paused  bool
+	players map[string]*Player
+	nextID  map[string]int
+}
+
+func NewWorld() *World {
+	return &World{
+		players: map[string]*Player{},
+		nextID:  map[string]int{},
+	}
+}
+
+func (w *World) SetPaused(paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = paused
+}
+
+func (w *World) Paused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// Player returns a copy of username's units. A player the world hasn't seen
+// yet has none.
+func (w *World) Player(username string) Player {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snapshot(w.player(username))
+}
+
+// player returns username's entry, creating it. It expects w.mu to be held.
+func (w *World) player(username string) *Player {
+	p, ok := w.players[username]
+	if !ok {
+		p = &Player{Username: username, Units: map[int]Unit{}}
+		w.players[username] = p
+	}
+	return p
+}
+
+// snapshot copies p. It expects w.mu to be held.
+func (w *World) snapshot(p *Player) Player {
+	units := map[int]Unit{}
+	for id, u := range p.Units {
+		units[id] = u
+	}
+	return Player{Username: p.Username, Units: units}
+}
+
+func (w *World) Spawn(req SpawnRequest) (Unit, error) {
+	if err := req.validate(); err != nil {
+		return Unit{}, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused {
+		return Unit{}, errors.New("the game is paused, you can not spawn units")
+	}
+
+	// IDs are never reused, so a dead unit's ID can't be moved again.
+	w.nextID[req.Username]++
+	u := Unit{
+		ID:       w.nextID[req.Username],
+		Rank:     req.Rank,
+		Location: req.Location,
+	}
+	w.player(req.Username).Units[u.ID] = u
+	return u, nil
+}
+
+// Move moves the player's units and fights a war against every other player
+// with units where they arrive, in username order, until the mover has no
+// units left there. The world only changes if announce, which gets the move
+// and the wars while the world is still locked, returns nil. The move only
+// carries the moved units, so announcing it doesn't tell other players where
+// the rest of the mover's units are.
+func (w *World) Move(req MoveRequest, announce func(ArmyMove, []WarResult) error) (ArmyMove, error) {
+	if err := req.validate(); err != nil {
+		return ArmyMove{}, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused {
+		return ArmyMove{}, errors.New("the game is paused, you can not move units")
+	}
+
+	// Play the move out on copies, so there is nothing to undo if announce
+	// fails.
+	players := make(map[string]*Player, len(w.players)+1)
+	for name, p := range w.players {
+		copied := w.snapshot(p)
+		players[name] = &copied
+	}
+	mover, ok := players[req.Username]
+	if !ok {
+		mover = &Player{Username: req.Username, Units: map[int]Unit{}}
+	}
+	moved := []Unit{}
+	seen := map[int]bool{}
+	for _, id := range req.UnitIDs {
+		if _, ok := mover.Units[id]; !ok {
+			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", id)
+		}
+		if seen[id] {
+			return ArmyMove{}, fmt.Errorf("error: unit with ID %v listed twice", id)
+		}
+		seen[id] = true
+	}
+	for _, id := range req.UnitIDs {
+		u := mover.Units[id]
+		u.Location = req.ToLocation
+		mover.Units[id] = u
+		moved = append(moved, u)
+	}
+	move := ArmyMove{
+		Player:     Player{Username: req.Username},
+		Units:      moved,
+		ToLocation: req.ToLocation,
+	}
+
+	var opponents []string
+	for name := range players {
+		if name != req.Username {
+			opponents = append(opponents, name)
+		}
+	}
+	sort.Strings(opponents)
+
+	var wars []WarResult
+	for _, name := range opponents {
+		attackers := unitsIn(mover, req.ToLocation)
+		defenders := unitsIn(players[name], req.ToLocation)
+		if len(attackers) == 0 {
+			break
+		}
+		if len(defenders) == 0 {
+			continue
+		}
+		wars = append(wars, w.fight(mover, players[name], req.ToLocation))
+	}
+
+	if err := announce(move, wars); err != nil {
+		return ArmyMove{}, err
+	}
+	w.players = players
+	return move, nil
+}
+
+// fight settles a war at loc like HandleWar does, killing the loser's units
+// there (everybody's, after a draw). It expects w.mu to be held.
+func (w *World) fight(attacker, defender *Player, loc Location) WarResult {
+	r := WarResult{
+		Attacker:      attacker.Username,
+		Defender:      defender.Username,
+		Location:      loc,
+		AttackerPower: unitsToPowerLevel(unitsIn(attacker, loc)),
+		DefenderPower: unitsToPowerLevel(unitsIn(defender, loc)),
+		Killed:        map[string][]int{},
+	}
+	var losers []*Player
+	switch {
+	case r.AttackerPower > r.DefenderPower:
+		r.Winner, r.Loser = attacker.Username, defender.Username
+		losers = []*Player{defender}
+	case r.DefenderPower > r.AttackerPower:
+		r.Winner, r.Loser = defender.Username, attacker.Username
+		losers = []*Player{attacker}
+	default:
+		r.Draw = true
+		losers = []*Player{attacker, defender}
+	}
+	for _, p := range losers {
+		for _, u := range unitsIn(p, loc) {
+			delete(p.Units, u.ID)
+			r.Killed[p.Username] = append(r.Killed[p.Username], u.ID)
+		}
+		sort.Ints(r.Killed[p.Username])
+	}
+	return r
+}
+
+func unitsIn(p *Player, loc Location) []Unit {
+	var units []Unit
+	for _, u := range p.Units {
+		if u.Location == loc {
+			units = append(units, u)
+		}
+	}
+	return units
+}
@@ -0,0 +1,58 @@
+package player
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func handlerPause(gs *gamelogic.GameState, out io.Writer) func(routing.PlayingState) pubsub.Acktype {
+	return func(ps routing.PlayingState) pubsub.Acktype {
+		gs.HandlePause(ps)
+		fmt.Fprintf(out, "Ack, because it's a PAUSE")
+		return pubsub.Ack
+	}
+}
+
+// handlerMove only shows the move: the server has already fought any war it
+// started, and the result arrives on its own.
+func handlerMove(gs *gamelogic.GameState, out io.Writer) func(pubsub.Delivery[gamelogic.ArmyMove]) pubsub.Acktype {
+	return func(d pubsub.Delivery[gamelogic.ArmyMove]) pubsub.Acktype {
+		switch gs.HandleMove(d.Body) {
+		case gamelogic.MoveOutcomeMakeWar:
+			fmt.Fprintf(out, "Ack, the server will settle the war")
+		case gamelogic.MoveOutComeSafe:
+			fmt.Fprintf(out, "Ack, because move outcome is 'safe'")
+		}
+		return pubsub.Ack
+	}
+}
+
+// handlerWar applies the server's verdict on a war to our units.
+func handlerWar(gs *gamelogic.GameState) func(pubsub.Delivery[gamelogic.WarResult]) pubsub.Acktype {
+	return func(d pubsub.Delivery[gamelogic.WarResult]) pubsub.Acktype {
+		gs.HandleWarResult(d.Body)
+		return pubsub.Ack
+	}
+}
+
+// handlerLobby tells the player who joined and who left the game.
+func handlerLobby(gs *gamelogic.GameState, out io.Writer) func(routing.Presence) pubsub.Acktype {
+	return func(p routing.Presence) pubsub.Acktype {
+		if p.Username == gs.GetUsername() {
+			return pubsub.Ack
+		}
+		switch p.Status {
+		case routing.PresenceJoin:
+			fmt.Fprintf(out, "%s joined the game.\n", p.Username)
+		case routing.PresenceLeave:
+			fmt.Fprintf(out, "%s left the game.\n", p.Username)
+		case routing.PresenceDrop:
+			fmt.Fprintf(out, "%s lost the connection.\n", p.Username)
+		}
+		return pubsub.Ack
+	}
+}
@@ -0,0 +1,308 @@
+// Package player is one player's side of a game of Peril, shared by the
+// terminal client and the WebSocket gateway. The server owns the game world:
+// a player asks it to spawn and move units, then keeps a copy of its own
+// units in sync with the answers and with the wars the server announces.
+package player
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Middleware is added around the player's handlers, for instance to redraw a
+// prompt or forward what happened to a browser. It runs once the server's
+// signature has been checked, and Recover is always added after it.
+type Middleware struct {
+	Pause []pubsub.Middleware[routing.PlayingState]
+	Moves []pubsub.Middleware[gamelogic.ArmyMove]
+	Wars  []pubsub.Middleware[gamelogic.WarResult]
+	Lobby []pubsub.Middleware[routing.Presence]
+	// Output is where the handlers describe what happens, e.g. os.Stdout
+	// for the terminal client. Nothing is printed if it's nil.
+	Output io.Writer
+}
+
+type Player struct {
+	State *gamelogic.GameState
+	game  string
+	rpc   *pubsub.RPCClient
+	subs  []*pubsub.Subscription
+
+	// signer signs what we send. server holds the server's key, which
+	// everything we receive has to be signed with.
+	signer pubsub.Signer
+	server *pubsub.Keyring
+	token  string
+	out    io.Writer
+
+	// Heartbeats go out on ch until stop is closed. The username is ours
+	// until we announce we're leaving on ch too.
+	ch   pubsub.Channel
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Join registers username in game gameID, subscribes it to the game's
+// pauses, moves, wars and comings and goings, then asks the server whether
+// the game is paused and which units the player already has. It fails if the
+// server doesn't know the game or someone else is playing as username. A
+// player whose connection dropped can take username back before the server
+// notices with the token they had (see Token). Until Close the player sends
+// heartbeats, so the server knows the username is still in use.
+func Join(ctx context.Context, broker pubsub.Broker, gameID, username, token string, mw Middleware) (*Player, error) {
+	if !routing.ValidName(gameID) || !routing.ValidName(username) {
+		return nil, errors.New("game IDs and usernames are 1 to 32 letters, digits, dashes or underscores")
+	}
+	rpc, err := pubsub.NewRPCClient(broker)
+	if err != nil {
+		return nil, err
+	}
+	p := &Player{
+		State:  gamelogic.NewGameState(username),
+		game:   gameID,
+		rpc:    rpc,
+		server: pubsub.NewKeyring(),
+		out:    mw.Output,
+	}
+	if p.out == nil {
+		p.out = io.Discard
+	}
+	p.State.SetOutput(p.out)
+
+	// Registering first spares a second player with the same name a
+	// cryptic error about exclusive queues.
+	reg, err := pubsub.Call[gamelogic.PlayerRequest, gamelogic.Registration](ctx, rpc, routing.ExchangePerilDirect, routing.RegisterRPCKey, gamelogic.PlayerRequest{GameID: gameID, Username: username, Token: token})
+	if err != nil {
+		rpc.Close()
+		if refused(err) {
+			return nil, rejected(err)
+		}
+		return nil, fmt.Errorf("could not register with the server: %w", err)
+	}
+	p.signer = pubsub.Signer{Identity: routing.PlayerIdentity(gameID, username), Key: reg.Key}
+	rpc.Signer = &p.signer
+	p.token = reg.Token
+	p.server.Add(routing.ServerIdentity, reg.ServerKey)
+	sealKeys := pubsub.NewSealKeys()
+	if err := sealKeys.Add(p.signer.Identity, reg.SealKey); err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.ch, err = broker.Channel()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	pauseSub, err := pubsub.SubscribeDelivery(ctx, broker, routing.ExchangePerilDirect, routing.GameKey(routing.PauseKey, gameID, username), routing.GameKey(routing.PauseKey, gameID), pubsub.SimpleQueueTypeTransient,
+		guarded(p.server, pubsub.BodyHandler(handlerPause(p.State, p.out)), mw.Pause),
+	)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.subs = append(p.subs, pauseSub)
+
+	// Moves and wars can be redelivered; handling a war twice would kill
+	// units twice, so both handlers skip messages they have already
+	// processed.
+	seen := pubsub.NewMemoryDedupStore(10000)
+
+	// CH4 L4
+	moveSub, err := pubsub.SubscribeDelivery(ctx, broker, routing.ExchangePerilTopic, routing.GameKey(routing.ArmyMovesPrefix, gameID, username), routing.GameKey(routing.ArmyMovesPrefix, gameID, "*"), pubsub.SimpleQueueTypeTransient,
+		guarded(p.server, pubsub.Deduplicate(seen, handlerMove(p.State, p.out)), mw.Moves),
+	)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.subs = append(p.subs, moveSub)
+
+	// Wars give away where units are, so the server seals each result for
+	// the two players who fought it and nobody else can read it.
+	warSub, err := pubsub.SubscribeDelivery(ctx, broker, routing.ExchangePerilTopic, routing.GameKey(routing.WarRecognitionsPrefix, gameID, username), routing.GameKey(routing.WarRecognitionsPrefix, gameID, username), pubsub.SimpleQueueTypeTransient,
+		guarded(p.server, pubsub.Deduplicate(seen, handlerWar(p.State)), mw.Wars),
+		pubsub.OpenWith(sealKeys),
+	)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.subs = append(p.subs, warSub)
+
+	lobbySub, err := pubsub.SubscribeDelivery(ctx, broker, routing.ExchangePerilTopic, routing.GameKey(routing.LobbyPrefix, gameID, username), routing.GameKey(routing.LobbyPrefix, gameID, "*"), pubsub.SimpleQueueTypeTransient,
+		guarded(p.server, pubsub.BodyHandler(handlerLobby(p.State, p.out)), mw.Lobby),
+	)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.subs = append(p.subs, lobbySub)
+
+	if err := p.sync(ctx); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	p.announce(routing.PresenceJoin)
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.heartbeat()
+	return p, nil
+}
+
+// heartbeat tells the server we're still here until Close.
+func (p *Player) heartbeat() {
+	defer close(p.done)
+	ticker := time.NewTicker(routing.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.announce(routing.PresenceHeartbeat)
+		}
+	}
+}
+
+// announce publishes our presence. A heartbeat that doesn't make it is what
+// the server is watching for anyway, so failures are ignored.
+func (p *Player) announce(status routing.PresenceStatus) {
+	pubsub.PublishJSON(p.Signed(p.ch), routing.ExchangePerilTopic, routing.GameKey(routing.PresencePrefix, p.game, p.State.GetUsername()), routing.Presence{
+		GameID:   p.game,
+		Username: p.State.GetUsername(),
+		Status:   status,
+		Time:     time.Now(),
+	})
+}
+
+// sync catches up with a game that started without us. Playing on without
+// the answers is possible, so only the server refusing them is an error;
+// other failures are reported.
+func (p *Player) sync(ctx context.Context) error {
+	state, err := pubsub.Call[string, routing.PlayingState](ctx, p.rpc, routing.ExchangePerilDirect, routing.PlayingStateRPCKey, p.game)
+	if err != nil {
+		if refused(err) {
+			return rejected(err)
+		}
+		fmt.Fprintln(p.out, "Could not ask the server whether the game is paused:", err)
+	} else if state.IsPaused {
+		p.State.HandlePause(state)
+	}
+
+	req := gamelogic.PlayerRequest{GameID: p.game, Username: p.State.GetUsername()}
+	me, err := pubsub.Call[gamelogic.PlayerRequest, gamelogic.Player](ctx, p.rpc, routing.ExchangePerilDirect, routing.PlayerRPCKey, req)
+	if err != nil {
+		if refused(err) {
+			return rejected(err)
+		}
+		fmt.Fprintln(p.out, "Could not ask the server for your units:", err)
+		return nil
+	}
+	for _, unit := range me.Units {
+		p.State.UpdateUnit(unit)
+	}
+	return nil
+}
+
+// Spawn asks the server for a unit and adds it once the server agrees.
+func (p *Player) Spawn(ctx context.Context, words []string) (gamelogic.Unit, error) {
+	req, err := gamelogic.NewSpawnRequest(p.game, p.State.GetUsername(), words)
+	if err != nil {
+		return gamelogic.Unit{}, err
+	}
+	unit, err := pubsub.Call[gamelogic.SpawnRequest, gamelogic.Unit](ctx, p.rpc, routing.ExchangePerilDirect, routing.SpawnRPCKey, req)
+	if err != nil {
+		return gamelogic.Unit{}, rejected(err)
+	}
+	p.State.ApplySpawn(unit)
+	return unit, nil
+}
+
+// Move asks the server to move units and moves them once it agrees. The
+// server announces the move to everybody else.
+func (p *Player) Move(ctx context.Context, words []string) (gamelogic.ArmyMove, error) {
+	req, err := gamelogic.NewMoveRequest(p.game, p.State.GetUsername(), words)
+	if err != nil {
+		return gamelogic.ArmyMove{}, err
+	}
+	move, err := pubsub.Call[gamelogic.MoveRequest, gamelogic.ArmyMove](ctx, p.rpc, routing.ExchangePerilDirect, routing.MoveRPCKey, req)
+	if err != nil {
+		return gamelogic.ArmyMove{}, rejected(err)
+	}
+	p.State.ApplyMove(move)
+	return move, nil
+}
+
+// Token is what Join needs to register the username again while the server
+// still counts this player as online.
+func (p *Player) Token() string {
+	return p.token
+}
+
+// Signed wraps pub so what it publishes is signed as this player, e.g. for
+// game logs, which the server only accepts from their author.
+func (p *Player) Signed(pub pubsub.Publisher) pubsub.Publisher {
+	return pubsub.SignAll(pub, p.signer)
+}
+
+// guarded only lets messages signed by the server through to mw and h, and
+// recovers from panics in either.
+func guarded[T any](server *pubsub.Keyring, h pubsub.Handler[T], mw []pubsub.Middleware[T]) pubsub.Handler[T] {
+	chain := append([]pubsub.Middleware[T]{pubsub.Verify(server, fromServer[T])}, mw...)
+	return pubsub.Chain(h, append(chain, pubsub.Recover[T])...)
+}
+
+// fromServer is the identity everything we subscribe to must be signed by.
+func fromServer[T any](T) string {
+	return routing.ServerIdentity
+}
+
+// refused reports whether err is the server's answer rather than a failure
+// to reach it.
+func refused(err error) bool {
+	var remote *pubsub.RemoteError
+	return errors.As(err, &remote)
+}
+
+// rejected strips the RPC wrapping off the server's reason for refusing a
+// command, which is meant for the player.
+func rejected(err error) error {
+	var remote *pubsub.RemoteError
+	if errors.As(err, &remote) {
+		return errors.New(remote.Message)
+	}
+	return err
+}
+
+// Close tells the server we're leaving and stops the subscriptions.
+func (p *Player) Close() error {
+	var errs []error
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+	}
+	if p.ch != nil {
+		p.announce(routing.PresenceLeave)
+		if err := p.ch.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, sub := range p.subs {
+		if err := sub.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := p.rpc.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,375 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AMQPBroker is the RabbitMQ implementation of Broker.
+type AMQPBroker struct {
+	conn *amqp.Connection
+}
+
+func NewAMQPBroker(conn *amqp.Connection) *AMQPBroker {
+	return &AMQPBroker{conn: conn}
+}
+
+// DialAMQP opens a connection to RabbitMQ and wraps it in a Broker.
+func DialAMQP(url string) (*AMQPBroker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(conn), nil
+}
+
+// DialAMQPConfig is DialAMQP with connection settings such as the vhost, the
+// heartbeat or TLS. Settings left at their zero value come from the URL.
+func DialAMQPConfig(url string, config amqp.Config) (*AMQPBroker, error) {
+	conn, err := amqp.DialConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPBroker(conn), nil
+}
+
+func (b *AMQPBroker) Conn() *amqp.Connection {
+	return b.conn
+}
+
+func (b *AMQPBroker) Channel() (Channel, error) {
+	ch, err := b.conn.Channel()
+	if err == amqp.ErrClosed {
+		return nil, ErrClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &amqpChannel{ch: ch, done: make(chan struct{})}, nil
+}
+
+func (b *AMQPBroker) Close() error {
+	return b.conn.Close()
+}
+
+func (b *AMQPBroker) NotifyClose(receiver chan error) chan error {
+	forwardCloseErrors(b.conn.NotifyClose(make(chan *amqp.Error, 1)), receiver)
+	return receiver
+}
+
+// InspectExchange uses a passive declare, which fails with 404 when the
+// exchange is missing. That kills the channel, so every check gets its own.
+// AMQP can't tell us the kind of an existing exchange.
+func (b *AMQPBroker) InspectExchange(name string) (string, bool, error) {
+	exists, err := b.passive(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclarePassive(name, "", false, false, false, false, nil)
+	})
+	return "", exists, err
+}
+
+func (b *AMQPBroker) QueueExists(name string) (bool, error) {
+	return b.passive(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclarePassive(name, false, false, false, false, nil)
+		return err
+	})
+}
+
+// CheckQueue is unsupported: AMQP has no way to read a queue's arguments
+// without declaring it.
+func (b *AMQPBroker) CheckQueue(name string, durable bool, args Table) error {
+	return errors.ErrUnsupported
+}
+
+// BindingExists is unsupported: AMQP has no way to list bindings.
+func (b *AMQPBroker) BindingExists(queue, key, exchange string) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func (b *AMQPBroker) passive(declare func(*amqp.Channel) error) (bool, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+
+	err = declare(ch)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		switch amqpErr.Code {
+		case amqp.NotFound:
+			return false, nil
+		case amqp.ResourceLocked:
+			// Someone else's exclusive queue: it exists.
+			return true, nil
+		}
+	}
+	return err == nil, err
+}
+
+func forwardCloseErrors(errs chan *amqp.Error, receiver chan error) {
+	go func() {
+		for err := range errs {
+			receiver <- err
+		}
+		close(receiver)
+	}()
+}
+
+type amqpChannel struct {
+	ch   *amqp.Channel
+	done chan struct{}
+	once sync.Once
+
+	confirmMu sync.Mutex
+	pending   map[uint64]pendingConfirm
+	returned  map[string]*Return
+}
+
+type pendingConfirm struct {
+	messageID string
+	result    chan Confirmation
+}
+
+func (c *amqpChannel) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	return c.ch.PublishWithContext(ctx, exchange, key, false, false, toPublishing(msg))
+}
+
+// toPublishing marks every message persistent, as setSTOMPMessage does, so
+// durable queues such as game_logs keep what the outbox relays to them
+// across a broker restart. Transient queues drop it either way.
+func toPublishing(msg Message) amqp.Publishing {
+	return amqp.Publishing{
+		DeliveryMode:  amqp.Persistent,
+		ContentType:   msg.ContentType,
+		Headers:       toAMQPTable(msg.Headers),
+		MessageId:     msg.MessageID,
+		CorrelationId: msg.CorrelationID,
+		Timestamp:     msg.Timestamp,
+		AppId:         msg.AppID,
+		ReplyTo:       msg.ReplyTo,
+		Body:          msg.Body,
+	}
+}
+
+func (c *amqpChannel) Confirm() error {
+	c.confirmMu.Lock()
+	defer c.confirmMu.Unlock()
+	if c.pending != nil {
+		return nil
+	}
+	if err := c.ch.Confirm(false); err != nil {
+		return err
+	}
+	c.pending = map[uint64]pendingConfirm{}
+	c.returned = map[string]*Return{}
+	confirms := c.ch.NotifyPublish(make(chan amqp.Confirmation))
+	returns := c.ch.NotifyReturn(make(chan amqp.Return))
+	go c.trackConfirms(confirms, returns)
+	return nil
+}
+
+func (c *amqpChannel) PublishConfirm(ctx context.Context, exchange, key string, msg Message) (<-chan Confirmation, error) {
+	c.confirmMu.Lock()
+	defer c.confirmMu.Unlock()
+	if c.pending == nil {
+		return nil, errors.New("pubsub: channel is not in confirm mode")
+	}
+
+	// Returns are matched to their confirmation through the message ID, so
+	// messages without one get one.
+	tag := c.ch.GetNextPublishSeqNo()
+	pub := toPublishing(msg)
+	if pub.MessageId == "" {
+		pub.MessageId = fmt.Sprintf("confirm-%d", tag)
+	}
+	result := make(chan Confirmation, 1)
+	c.pending[tag] = pendingConfirm{messageID: pub.MessageId, result: result}
+	if err := c.ch.PublishWithContext(ctx, exchange, key, true, false, pub); err != nil {
+		delete(c.pending, tag)
+		return nil, err
+	}
+	return result, nil
+}
+
+// trackConfirms resolves pending confirms. Both notification channels are
+// unbuffered and read from this single goroutine, so a basic.return is always
+// seen before the ack of the same message.
+func (c *amqpChannel) trackConfirms(confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.confirmMu.Lock()
+			c.returned[r.MessageId] = &Return{
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				ReplyCode:  int(r.ReplyCode),
+				ReplyText:  r.ReplyText,
+			}
+			c.confirmMu.Unlock()
+		case conf, ok := <-confirms:
+			c.confirmMu.Lock()
+			if !ok {
+				for tag, p := range c.pending {
+					close(p.result)
+					delete(c.pending, tag)
+				}
+				c.confirmMu.Unlock()
+				return
+			}
+			p, found := c.pending[conf.DeliveryTag]
+			delete(c.pending, conf.DeliveryTag)
+			ret := c.returned[p.messageID]
+			delete(c.returned, p.messageID)
+			c.confirmMu.Unlock()
+			if found {
+				p.result <- Confirmation{Ack: conf.Ack, Returned: ret}
+			}
+		}
+	}
+}
+
+func (c *amqpChannel) ExchangeDeclare(name, kind string, durable bool, args Table) error {
+	return c.ch.ExchangeDeclare(name, kind, durable, false, false, false, amqp.Table(args))
+}
+
+func (c *amqpChannel) QueueDeclare(name string, durable, autoDelete, exclusive bool, args Table) (Queue, error) {
+	q, err := c.ch.QueueDeclare(name, durable, autoDelete, exclusive, false, amqp.Table(args))
+	if err != nil {
+		return Queue{}, err
+	}
+	return Queue{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}, nil
+}
+
+func (c *amqpChannel) QueueBind(name, key, exchange string, args Table) error {
+	return c.ch.QueueBind(name, key, exchange, false, amqp.Table(args))
+}
+
+// Consume uses manual acks, except on ReplyToQueue which RabbitMQ only
+// allows in auto-ack mode.
+func (c *amqpChannel) Consume(queue, consumer string) (<-chan RawDelivery, error) {
+	autoAck := queue == ReplyToQueue
+	msgs, err := c.ch.Consume(queue, consumer, autoAck, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(chan RawDelivery)
+	go func() {
+		defer close(deliveries)
+		for msg := range msgs {
+			d := fromAMQPDelivery(msg)
+			if autoAck {
+				d.acker = autoAcker{}
+			}
+			select {
+			case deliveries <- d:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// Qos sets the prefetch for consumers started afterwards on this channel.
+// RabbitMQ does not implement prefetch size and rejects anything but 0.
+func (c *amqpChannel) Qos(prefetchCount, prefetchSize int) error {
+	return c.ch.Qos(prefetchCount, prefetchSize, false)
+}
+
+func (c *amqpChannel) Cancel(consumer string) error {
+	return c.ch.Cancel(consumer, false)
+}
+
+func (c *amqpChannel) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.ch.Close()
+}
+
+func (c *amqpChannel) NotifyClose(receiver chan error) chan error {
+	forwardCloseErrors(c.ch.NotifyClose(make(chan *amqp.Error, 1)), receiver)
+	return receiver
+}
+
+func fromAMQPDelivery(msg amqp.Delivery) RawDelivery {
+	return RawDelivery{
+		Message: Message{
+			ContentType:   msg.ContentType,
+			Headers:       fromAMQPTable(msg.Headers),
+			MessageID:     msg.MessageId,
+			CorrelationID: msg.CorrelationId,
+			Timestamp:     msg.Timestamp,
+			AppID:         msg.AppId,
+			ReplyTo:       msg.ReplyTo,
+			Body:          msg.Body,
+		},
+		Exchange:    msg.Exchange,
+		RoutingKey:  msg.RoutingKey,
+		Redelivered: msg.Redelivered,
+		acker:       amqpAcker{msg: msg},
+	}
+}
+
+// fromAMQPTable and toAMQPTable convert nested tables too (x-death is a list
+// of them), so header code only ever sees Table.
+func fromAMQPTable(t amqp.Table) Table {
+	if t == nil {
+		return nil
+	}
+	out := make(Table, len(t))
+	for k, v := range t {
+		out[k] = convertTables(v, func(t amqp.Table) any { return fromAMQPTable(t) }, nil)
+	}
+	return out
+}
+
+func toAMQPTable(t Table) amqp.Table {
+	if t == nil {
+		return nil
+	}
+	out := make(amqp.Table, len(t))
+	for k, v := range t {
+		out[k] = convertTables(v, nil, func(t Table) any { return toAMQPTable(t) })
+	}
+	return out
+}
+
+func convertTables(v any, from func(amqp.Table) any, to func(Table) any) any {
+	switch v := v.(type) {
+	case amqp.Table:
+		if from != nil {
+			return from(v)
+		}
+	case Table:
+		if to != nil {
+			return to(v)
+		}
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = convertTables(item, from, to)
+		}
+		return out
+	}
+	return v
+}
+
+type amqpAcker struct {
+	msg amqp.Delivery
+}
+
+func (a amqpAcker) Ack() error {
+	return a.msg.Ack(false)
+}
+
+func (a amqpAcker) Nack(requeue bool) error {
+	return a.msg.Nack(false, requeue)
+}
@@ -0,0 +1,13 @@
+package pubsub
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestPublishingIsPersistent(t *testing.T) {
+	if mode := toPublishing(Message{Body: []byte("alice moved")}).DeliveryMode; mode != amqp.Persistent {
+		t.Errorf("delivery mode %d, want persistent", mode)
+	}
+}
@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Exchange kinds understood by every Broker implementation.
+const (
+	ExchangeDirect = "direct"
+	ExchangeTopic  = "topic"
+	ExchangeFanout = "fanout"
+)
+
+var (
+	ErrClosed           = errors.New("pubsub: channel or connection is closed")
+	ErrConnectionForced = errors.New("pubsub: connection closed by the broker")
+	ErrDisconnected     = errors.New("pubsub: not connected, reconnecting")
+	ErrExchangeNotFound = errors.New("pubsub: exchange not found")
+	ErrQueueNotFound    = errors.New("pubsub: queue not found")
+	ErrResourceLocked   = errors.New("pubsub: queue is exclusive to another connection")
+	// ErrPreconditionFailed is RabbitMQ's PRECONDITION_FAILED: something was
+	// redeclared with different properties or arguments.
+	ErrPreconditionFailed = errors.New("pubsub: precondition failed")
+)
+
+var consumerSeq atomic.Uint64
+
+// newConsumerTag returns a process-unique consumer tag, so subscriptions can
+// be cancelled later without asking the broker what tag it picked.
+func newConsumerTag() string {
+	return fmt.Sprintf("peril-%d-%d", os.Getpid(), consumerSeq.Add(1))
+}
+
+// Table holds message headers and queue/exchange arguments.
+type Table map[string]any
+
+// Message is what gets published. It is independent of the transport.
+// Publish fills in the metadata, see Metadata.
+type Message struct {
+	ContentType   string
+	Headers       Table
+	MessageID     string
+	CorrelationID string
+	Timestamp     time.Time
+	AppID         string
+	ReplyTo       string
+	Body          []byte
+}
+
+// RawDelivery is a message received from a queue. It has to be acked or nacked.
+type RawDelivery struct {
+	Message
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+
+	acker acknowledger
+}
+
+type acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+}
+
+// autoAcker is used for deliveries the broker already considers acked, like
+// replies on ReplyToQueue.
+type autoAcker struct{}
+
+func (autoAcker) Ack() error              { return nil }
+func (autoAcker) Nack(requeue bool) error { return nil }
+
+func (d RawDelivery) Ack() error {
+	if d.acker == nil {
+		return ErrClosed
+	}
+	return d.acker.Ack()
+}
+
+func (d RawDelivery) Nack(requeue bool) error {
+	if d.acker == nil {
+		return ErrClosed
+	}
+	return d.acker.Nack(requeue)
+}
+
+// Queue describes a declared queue.
+type Queue struct {
+	Name      string
+	Messages  int
+	Consumers int
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, exchange, key string, msg Message) error
+}
+
+type Subscriber interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive bool, args Table) (Queue, error)
+	QueueBind(name, key, exchange string, args Table) error
+	Qos(prefetchCount, prefetchSize int) error
+	Consume(queue, consumer string) (<-chan RawDelivery, error)
+	Cancel(consumer string) error
+}
+
+// Channel mirrors an AMQP channel: a lightweight session on top of a Broker.
+type Channel interface {
+	Publisher
+	Subscriber
+	ExchangeDeclare(name, kind string, durable bool, args Table) error
+	Close() error
+}
+
+// Broker is a connection to a message broker. The RabbitMQ (amqp091-go)
+// connection, the STOMP connection and the in-memory broker implement it.
+type Broker interface {
+	Channel() (Channel, error)
+	Close() error
+}
@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeGob     = "application/gob"
+	ContentTypeMsgPack = "application/msgpack"
+	ContentTypeCBOR    = "application/cbor"
+)
+
+// Codec turns values into message bodies and back. Each codec owns one
+// content type, which is set on publish and used to pick the decoder on
+// consume.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	Gob     Codec = gobCodec{}
+	MsgPack Codec = msgpackCodec{}
+	CBOR    Codec = cborCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{
+	m: map[string]Codec{
+		ContentTypeJSON:    JSON,
+		ContentTypeGob:     Gob,
+		ContentTypeMsgPack: MsgPack,
+		ContentTypeCBOR:    CBOR,
+	},
+}
+
+// RegisterCodec makes a codec available to Subscribe. It replaces any codec
+// already registered for the same content type.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[c.ContentType()] = c
+}
+
+// LookupCodec finds the codec for a content type. Parameters such as
+// "; charset=utf-8" are ignored.
+func LookupCodec(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: bad content type %q: %w", contentType, err)
+	}
+
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.m[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("pubsub: no codec registered for %q", mediaType)
+	}
+	return c, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	return dec.Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return ContentTypeMsgPack }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+type cborCodec struct{}
+
+// cborEncMode keeps sub-second precision on times, like the other codecs.
+var cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+func (cborCodec) ContentType() string { return ContentTypeCBOR }
+
+func (cborCodec) Marshal(v any) ([]byte, error) { return cborEncMode.Marshal(v) }
+
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type codecWar struct {
+	Attacker string
+	Power    int
+	At       time.Time
+	Killed   map[string][]int
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	want := codecWar{
+		Attacker: "alice",
+		Power:    12,
+		At:       time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC),
+		Killed:   map[string][]int{"bob": {1, 4}},
+	}
+	for _, codec := range []Codec{JSON, Gob, MsgPack, CBOR} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			data, err := codec.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got codecWar
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.At.Equal(want.At) {
+				t.Errorf("time came back as %s, want %s", got.At, want.At)
+			}
+			got.At = want.At
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+
+			if found, err := LookupCodec(codec.ContentType() + "; charset=utf-8"); err != nil || found != codec {
+				t.Errorf("LookupCodec found %v (%v)", found, err)
+			}
+		})
+	}
+}
+
+func TestSubscribeDecodesByContentType(t *testing.T) {
+	b, ch := memoryChannel(t)
+	if err := ch.ExchangeDeclare("peril_topic", ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := b.Dial()
+	defer conn.Close()
+	handled := make(chan codecWar, 4)
+	sub, err := Subscribe(context.Background(), conn, "peril_topic", "war", "war.*", SimpleQueueTypeTransient, func(war codecWar) Acktype {
+		handled <- war
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// One subscription takes every registered codec.
+	codecs := []Codec{JSON, Gob, MsgPack, CBOR}
+	for _, codec := range codecs {
+		if err := Publish(ch, codec, "peril_topic", "war.alice", codecWar{Attacker: codec.ContentType()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, codec := range codecs {
+		select {
+		case war := <-handled:
+			if war.Attacker != codec.ContentType() {
+				t.Errorf("got %q, want the %s message", war.Attacker, codec.ContentType())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the %s message was not handled", codec.ContentType())
+		}
+	}
+}
+
+func TestLookupUnknownCodec(t *testing.T) {
+	for _, contentType := range []string{"text/csv", "", "application/json; charset"} {
+		if _, err := LookupCodec(contentType); err == nil {
+			t.Errorf("LookupCodec(%q) found a codec", contentType)
+		}
+	}
+}
+
+// upperCodec is a made-up codec that shouts its strings.
+type upperCodec struct{}
+
+func (upperCodec) ContentType() string           { return "application/x-peril-upper" }
+func (upperCodec) Marshal(v any) ([]byte, error) { return []byte(strings.ToUpper(v.(string))), nil }
+func (upperCodec) Unmarshal(data []byte, v any) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec(upperCodec{})
+	codec, err := LookupCodec("application/x-peril-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := codec.Marshal("pause")
+	var got string
+	if err := decode(RawDelivery{Message: Message{ContentType: codec.ContentType(), Body: data}}, &got); err != nil || got != "PAUSE" {
+		t.Errorf("decoded %q (%v), want PAUSE", got, err)
+	}
+}
@@ -0,0 +1,149 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNacked = errors.New("pubsub: message nacked by the broker")
+
+// UnroutableError is returned when a confirmed publish reached the exchange
+// but no queue was bound to receive it.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  int
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("pubsub: message to %s with key %q was returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// Return describes a mandatory message the broker could not route.
+type Return struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  int
+	ReplyText  string
+}
+
+// Confirmation is the broker's answer to a confirmed publish. Returned is set
+// when the message was acked but routed to zero queues.
+type Confirmation struct {
+	Ack      bool
+	Returned *Return
+}
+
+// ConfirmChannel is a Channel that supports publisher confirms. Messages sent
+// with PublishConfirm are mandatory, so unroutable ones come back in the
+// Confirmation instead of being dropped silently.
+type ConfirmChannel interface {
+	Channel
+	Confirm() error
+	PublishConfirm(ctx context.Context, exchange, key string, msg Message) (<-chan Confirmation, error)
+}
+
+const DefaultConfirmTimeout = 5 * time.Second
+
+// ConfirmingPublisher is a Publisher that waits for the broker to confirm
+// every message. It can be passed anywhere a Publisher is expected, so
+// PublishJSON and PublishGob report dropped and unroutable messages.
+type ConfirmingPublisher struct {
+	ch ConfirmChannel
+	// Timeout bounds the wait when the context has no deadline of its own.
+	Timeout time.Duration
+}
+
+// NewConfirmingPublisher puts ch into confirm mode.
+func NewConfirmingPublisher(ch Channel) (*ConfirmingPublisher, error) {
+	cc, ok := ch.(ConfirmChannel)
+	if !ok {
+		return nil, errors.New("pubsub: channel does not support publisher confirms")
+	}
+	if err := cc.Confirm(); err != nil {
+		return nil, err
+	}
+	return &ConfirmingPublisher{ch: cc, Timeout: DefaultConfirmTimeout}, nil
+}
+
+func (p *ConfirmingPublisher) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	pending, err := p.ch.PublishConfirm(ctx, exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	return p.wait(ctx, exchange, key, pending)
+}
+
+func (p *ConfirmingPublisher) wait(ctx context.Context, exchange, key string, pending <-chan Confirmation) error {
+	if _, ok := ctx.Deadline(); !ok && p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	select {
+	case c, ok := <-pending:
+		if !ok {
+			return fmt.Errorf("pubsub: confirmation lost: %w", ErrClosed)
+		}
+		if !c.Ack {
+			return ErrNacked
+		}
+		if c.Returned != nil {
+			return &UnroutableError{
+				Exchange:   exchange,
+				RoutingKey: key,
+				ReplyCode:  c.Returned.ReplyCode,
+				ReplyText:  c.Returned.ReplyText,
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("pubsub: waiting for confirmation: %w", ctx.Err())
+	}
+}
+
+// Batch starts a batch of confirmed publishes. Publish on the batch does not
+// wait; call Wait once at the end to collect every confirmation.
+func (p *ConfirmingPublisher) Batch() *Batch {
+	return &Batch{p: p}
+}
+
+type Batch struct {
+	p       *ConfirmingPublisher
+	pending []batchItem
+	errs    []error
+}
+
+type batchItem struct {
+	exchange string
+	key      string
+	pending  <-chan Confirmation
+}
+
+func (b *Batch) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	pending, err := b.p.ch.PublishConfirm(ctx, exchange, key, msg)
+	if err != nil {
+		b.errs = append(b.errs, err)
+		return err
+	}
+	b.pending = append(b.pending, batchItem{exchange: exchange, key: key, pending: pending})
+	return nil
+}
+
+// Wait blocks until every message in the batch is confirmed and returns all
+// the failures joined together.
+func (b *Batch) Wait(ctx context.Context) error {
+	errs := b.errs
+	for _, item := range b.pending {
+		if err := b.p.wait(ctx, item.exchange, item.key, item.pending); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.pending = nil
+	b.errs = nil
+	return errors.Join(errs...)
+}
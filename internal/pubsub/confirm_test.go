@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// confirmingPublisher puts a MemoryBroker channel in confirm mode, with a
+// queue bound to peril_direct that takes one message and rejects the rest.
+func confirmingPublisher(t *testing.T) *ConfirmingPublisher {
+	t.Helper()
+	_, ch := memoryChannel(t)
+	if err := ch.ExchangeDeclare("peril_direct", ExchangeDirect, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeclareQueue(ch, "pause", SimpleQueueTypeDurable, WithMaxLength(1, OverflowRejectPublish)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("pause", "pause", "peril_direct", nil); err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := NewConfirmingPublisher(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publisher
+}
+
+func TestConfirmingPublisher(t *testing.T) {
+	publisher := confirmingPublisher(t)
+	if err := PublishJSON(publisher, "peril_direct", "pause", "paused"); err != nil {
+		t.Fatalf("routed message: %s", err)
+	}
+	if err := PublishJSON(publisher, "peril_direct", "pause", "paused again"); !errors.Is(err, ErrNacked) {
+		t.Errorf("message the full queue rejected: got %v, want ErrNacked", err)
+	}
+	err := PublishJSON(publisher, "peril_direct", "nobody", "hello")
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) || unroutable.Exchange != "peril_direct" || unroutable.RoutingKey != "nobody" {
+		t.Errorf("message no queue was bound for: got %v, want an UnroutableError", err)
+	}
+}
+
+func TestConfirmingBatch(t *testing.T) {
+	publisher := confirmingPublisher(t)
+	batch := publisher.Batch()
+	for _, key := range []string{"pause", "pause", "nobody"} {
+		if err := PublishJSON(batch, "peril_direct", key, "paused"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := batch.Wait(context.Background())
+	var unroutable *UnroutableError
+	if !errors.Is(err, ErrNacked) || !errors.As(err, &unroutable) {
+		t.Errorf("got %v, want both the nack and the unroutable message", err)
+	}
+	// Wait starts over once it has collected the batch.
+	if err := batch.Wait(context.Background()); err != nil {
+		t.Errorf("waiting on an empty batch: %v", err)
+	}
+}
+
+// silentChannel never confirms anything.
+type silentChannel struct {
+	Channel
+}
+
+func (silentChannel) Confirm() error { return nil }
+
+func (silentChannel) PublishConfirm(context.Context, string, string, Message) (<-chan Confirmation, error) {
+	return make(chan Confirmation), nil
+}
+
+func TestConfirmingPublisherTimesOut(t *testing.T) {
+	publisher, err := NewConfirmingPublisher(silentChannel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.Timeout = 20 * time.Millisecond
+	if err := PublishJSON(publisher, "peril_direct", "pause", "paused"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the confirm timeout", err)
+	}
+}
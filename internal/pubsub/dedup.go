@@ -0,0 +1,238 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DedupStore remembers the IDs of messages that have been processed.
+type DedupStore interface {
+	Seen(id string) (bool, error)
+	Mark(id string) error
+}
+
+// Deduplicate makes handler idempotent: a message whose ID is already in
+// store is acked without calling handler again. Only messages the handler
+// finished with (Ack or NackDiscard) are remembered, so requeued and retried
+// ones still get their next attempt. Messages without an ID pass straight
+// through.
+func Deduplicate[T any](store DedupStore, handler Handler[T]) Handler[T] {
+	var mu sync.Mutex
+	// inFlight holds a channel per ID being handled, closed once it's done.
+	inFlight := map[string]chan struct{}{}
+
+	return func(d Delivery[T]) Acktype {
+		id := d.MessageID
+		if id == "" {
+			return handler(d)
+		}
+
+		// A copy that arrives while the first one is still being handled
+		// (another worker, a redelivery after reconnecting) waits for it
+		// to finish, then finds it in store or gets its own attempt.
+		// Requeueing it instead would spin it through the broker.
+		mu.Lock()
+		for {
+			busy, ok := inFlight[id]
+			if !ok {
+				break
+			}
+			mu.Unlock()
+			select {
+			case <-busy:
+			case <-d.Context().Done():
+				return NackRequeue
+			}
+			mu.Lock()
+		}
+		done := make(chan struct{})
+		inFlight[id] = done
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(inFlight, id)
+			mu.Unlock()
+			close(done)
+		}()
+
+		seen, err := store.Seen(id)
+		if err != nil {
+			log.Printf("pubsub: could not check message %s for duplicates: %s", id, err)
+			return NackRetry
+		}
+		if seen {
+			return Ack
+		}
+
+		acktype := handler(d)
+		if acktype == Ack || acktype == NackDiscard {
+			if err := store.Mark(id); err != nil {
+				log.Printf("pubsub: could not remember message %s: %s", id, err)
+			}
+		}
+		return acktype
+	}
+}
+
+// MemoryDedupStore keeps the last capacity IDs in memory.
+type MemoryDedupStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	ids      map[string]*list.Element
+}
+
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		order:    list.New(),
+		ids:      map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.ids[id]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+	return ok, nil
+}
+
+func (s *MemoryDedupStore) Mark(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(id)
+	return nil
+}
+
+// add records id and evicts the least recently used IDs over capacity. It
+// expects s.mu to be held.
+func (s *MemoryDedupStore) add(id string) {
+	if e, ok := s.ids[id]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+	s.ids[id] = s.order.PushFront(id)
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(string))
+	}
+}
+
+// FileDedupStore is a MemoryDedupStore that survives restarts. Every ID is
+// appended to a file, which is read back on open and compacted once it holds
+// twice as many IDs as are kept.
+type FileDedupStore struct {
+	mem   *MemoryDedupStore
+	path  string
+	file  *os.File
+	lines int
+}
+
+func OpenFileDedupStore(path string, capacity int) (*FileDedupStore, error) {
+	s := &FileDedupStore{
+		mem:  NewMemoryDedupStore(capacity),
+		path: path,
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if id := scanner.Text(); id != "" {
+				s.mem.add(id)
+				s.lines++
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	s.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDedupStore) Seen(id string) (bool, error) {
+	return s.mem.Seen(id)
+}
+
+// Mark syncs the file before returning, so an acked message is never
+// forgotten by a crash.
+func (s *FileDedupStore) Mark(id string) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if s.file == nil {
+		return ErrClosed
+	}
+	s.mem.add(id)
+	if _, err := fmt.Fprintln(s.file, id); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines > 2*s.mem.capacity {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact rewrites the file with only the IDs still kept, oldest first. It
+// expects s.mem.mu to be held.
+func (s *FileDedupStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for e := s.mem.order.Back(); e != nil; e = e.Prev() {
+		fmt.Fprintln(w, e.Value.(string))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.file.Close()
+	s.file = tmp
+	s.lines = s.mem.order.Len()
+	return nil
+}
+
+func (s *FileDedupStore) Close() error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if s.file == nil {
+		return ErrClosed
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
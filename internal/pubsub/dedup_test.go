@@ -0,0 +1,149 @@
+package pubsub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func expectSeen(t *testing.T, store DedupStore, seen map[string]bool) {
+	t.Helper()
+	for id, want := range seen {
+		got, err := store.Seen(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Seen(%s) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestMemoryDedupStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryDedupStore(2)
+	store.Mark("a")
+	store.Mark("b")
+	// Checking a makes b the least recently used.
+	expectSeen(t, store, map[string]bool{"a": true})
+	store.Mark("c")
+	expectSeen(t, store, map[string]bool{"a": true, "b": false, "c": true})
+}
+
+func TestFileDedupStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log.seen")
+	store, err := OpenFileDedupStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := store.Mark(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Mark("c"); err != ErrClosed {
+		t.Errorf("marking after Close: got %v, want ErrClosed", err)
+	}
+
+	store, err = OpenFileDedupStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	expectSeen(t, store, map[string]bool{"a": true, "b": true, "c": false})
+}
+
+func TestFileDedupStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log.seen")
+	store, err := OpenFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fifth line is more than twice the capacity.
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := store.Mark(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readIDs := func() string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(strings.Fields(string(data)), " ")
+	}
+	if ids := readIDs(); ids != "d e" {
+		t.Errorf("compacted file holds %q, want the two kept IDs, oldest first", ids)
+	}
+	// The compacted file is the one written to from now on.
+	if err := store.Mark("f"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := readIDs(); ids != "d e f" {
+		t.Errorf("file holds %q after compacting and marking f", ids)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	expectSeen(t, store, map[string]bool{"a": false, "d": false, "e": true, "f": true})
+}
+
+func TestDeduplicateHoldsCopyInFlight(t *testing.T) {
+	for _, tt := range []struct {
+		first     Acktype
+		wantCalls int32
+	}{
+		// The copy is a duplicate once the first one is acked...
+		{Ack, 1},
+		// ...but gets its own attempt if the first one is put back.
+		{NackRequeue, 2},
+	} {
+		var calls atomic.Int32
+		started := make(chan struct{})
+		release := make(chan struct{})
+		handler := Deduplicate(NewMemoryDedupStore(10), func(d Delivery[string]) Acktype {
+			if calls.Add(1) == 1 {
+				close(started)
+				<-release
+				return tt.first
+			}
+			return Ack
+		})
+		d := Delivery[string]{Body: "alice won", Metadata: Metadata{MessageID: "m1"}}
+
+		go handler(d)
+		<-started
+		copyDone := make(chan Acktype, 1)
+		go func() { copyDone <- handler(d) }()
+		select {
+		case acktype := <-copyDone:
+			t.Fatalf("first copy %s: the second returned %s while the first was being handled", tt.first, acktype)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(release)
+		select {
+		case acktype := <-copyDone:
+			if acktype != Ack {
+				t.Errorf("first copy %s: second copy got %s, want Ack", tt.first, acktype)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("first copy %s: the second copy was never settled", tt.first)
+		}
+		if n := calls.Load(); n != tt.wantCalls {
+			t.Errorf("first copy %s: handler called %d times, want %d", tt.first, n, tt.wantCalls)
+		}
+	}
+}
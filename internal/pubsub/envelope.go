@@ -0,0 +1,208 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Headers for the metadata AMQP has no property for.
+const (
+	HeaderCausationID   = "x-causation-id"
+	HeaderSchemaVersion = "x-schema-version"
+)
+
+// DefaultSchemaVersion is stamped on messages that don't ask for another one.
+// Bump it with WithSchemaVersion when a routing type changes incompatibly.
+const DefaultSchemaVersion = 1
+
+// AppID names this process in every message it publishes.
+var AppID = filepath.Base(os.Args[0])
+
+// Metadata is stamped on every message by Publish. The correlation ID is
+// shared by a whole chain of messages (a move, the war it started, the logs
+// of that war) and the causation ID points at the message right before.
+type Metadata struct {
+	MessageID     string
+	CorrelationID string
+	CausationID   string
+	AppID         string
+	Timestamp     time.Time
+	SchemaVersion int
+}
+
+// MetadataOf reads the metadata back out of msg.
+func MetadataOf(msg Message) Metadata {
+	meta := Metadata{
+		MessageID:     msg.MessageID,
+		CorrelationID: msg.CorrelationID,
+		AppID:         msg.AppID,
+		Timestamp:     msg.Timestamp,
+	}
+	meta.CausationID, _ = msg.Headers[HeaderCausationID].(string)
+	if v, ok := tableInt(msg.Headers, HeaderSchemaVersion); ok {
+		meta.SchemaVersion = int(v)
+	}
+	return meta
+}
+
+// PublishOption adjusts a message before Publish sends it.
+type PublishOption func(*Message)
+
+func WithMessageID(id string) PublishOption {
+	return func(msg *Message) {
+		msg.MessageID = id
+	}
+}
+
+func WithCorrelationID(id string) PublishOption {
+	return func(msg *Message) {
+		msg.CorrelationID = id
+	}
+}
+
+func WithSchemaVersion(version int) PublishOption {
+	return func(msg *Message) {
+		msg.Headers[HeaderSchemaVersion] = int64(version)
+	}
+}
+
+// WithReplyTo asks whoever handles the message to answer on queue.
+func WithReplyTo(queue string) PublishOption {
+	return func(msg *Message) {
+		msg.ReplyTo = queue
+	}
+}
+
+func WithHeader(key string, value any) PublishOption {
+	return func(msg *Message) {
+		msg.Headers[key] = value
+	}
+}
+
+// CausedBy marks the message as a consequence of the one described by cause:
+// it joins cause's correlation and points its causation ID at it.
+func CausedBy(cause Metadata) PublishOption {
+	return func(msg *Message) {
+		msg.CorrelationID = cause.CorrelationID
+		if msg.CorrelationID == "" {
+			msg.CorrelationID = cause.MessageID
+		}
+		msg.Headers[HeaderCausationID] = cause.MessageID
+	}
+}
+
+// NewMessageID returns a random 128-bit ID.
+func NewMessageID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// stamp fills in msg's metadata. A message that wasn't caused by another
+// one starts its own correlation.
+func stamp(msg *Message, opts []PublishOption) {
+	msg.MessageID = NewMessageID()
+	msg.Timestamp = time.Now()
+	msg.AppID = AppID
+	if msg.Headers == nil {
+		msg.Headers = Table{}
+	}
+	msg.Headers[HeaderSchemaVersion] = int64(DefaultSchemaVersion)
+	for _, opt := range opts {
+		opt(msg)
+	}
+	if msg.CorrelationID == "" {
+		msg.CorrelationID = msg.MessageID
+	}
+}
+
+// Death is one entry of the x-death header the broker adds every time a
+// message is dead-lettered.
+type Death struct {
+	Queue       string
+	Reason      string
+	Exchange    string
+	RoutingKeys []string
+	Count       int64
+	Time        time.Time
+}
+
+// Deaths parses the x-death header, most recent first.
+func Deaths(headers Table) []Death {
+	entries, _ := headers["x-death"].([]any)
+	var deaths []Death
+	for _, entry := range entries {
+		t, ok := entry.(Table)
+		if !ok {
+			continue
+		}
+		d := Death{}
+		d.Queue, _ = t["queue"].(string)
+		d.Reason, _ = t["reason"].(string)
+		d.Exchange, _ = t["exchange"].(string)
+		d.Count, _ = tableInt(t, "count")
+		d.Time, _ = t["time"].(time.Time)
+		keys, _ := t["routing-keys"].([]any)
+		for _, k := range keys {
+			if s, ok := k.(string); ok {
+				d.RoutingKeys = append(d.RoutingKeys, s)
+			}
+		}
+		deaths = append(deaths, d)
+	}
+	return deaths
+}
+
+// Delivery is what SubscribeDelivery hands to handlers: the decoded body
+// together with the message's metadata and routing details.
+type Delivery[T any] struct {
+	ctx context.Context
+
+	Body T
+	Metadata
+	ContentType string
+	ReplyTo     string
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	Deaths      []Death
+
+	// raw is the message as received, for middleware that checks it.
+	raw Message
+}
+
+// Context is cancelled when the subscription stops, or earlier under the
+// Timeout middleware. It is never nil.
+func (d Delivery[T]) Context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// WithContext returns a copy of d carrying ctx, for middleware.
+func (d Delivery[T]) WithContext(ctx context.Context) Delivery[T] {
+	d.ctx = ctx
+	return d
+}
+
+func newDelivery[T any](ctx context.Context, raw RawDelivery, body T) Delivery[T] {
+	return Delivery[T]{
+		ctx:         ctx,
+		Body:        body,
+		Metadata:    MetadataOf(raw.Message),
+		ContentType: raw.ContentType,
+		ReplyTo:     raw.ReplyTo,
+		Exchange:    raw.Exchange,
+		RoutingKey:  raw.RoutingKey,
+		Redelivered: raw.Redelivered,
+		Deaths:      Deaths(raw.Headers),
+		raw:         raw.Message,
+	}
+}
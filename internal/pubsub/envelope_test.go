@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// recorder is a Publisher that keeps what it is given.
+type recorder []Message
+
+func (r *recorder) Publish(_ context.Context, _, _ string, msg Message) error {
+	*r = append(*r, msg)
+	return nil
+}
+
+func TestPublishStampsMetadata(t *testing.T) {
+	var sent recorder
+	before := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := PublishJSON(&sent, "peril_topic", "army_moves.g1.alice", "move"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := MetadataOf(sent[0]), MetadataOf(sent[1])
+	if first.MessageID == "" || first.MessageID == second.MessageID {
+		t.Errorf("message IDs %q and %q, want two different ones", first.MessageID, second.MessageID)
+	}
+	if first.CorrelationID != first.MessageID || first.CausationID != "" {
+		t.Errorf("an uncaused message has correlation %q and causation %q, want its own ID and none", first.CorrelationID, first.CausationID)
+	}
+	if first.Timestamp.Before(before) || first.Timestamp.After(time.Now()) {
+		t.Errorf("timestamp %s is not the time of publishing", first.Timestamp)
+	}
+	if first.AppID != AppID || first.SchemaVersion != DefaultSchemaVersion {
+		t.Errorf("app %q and schema version %d, want %q and %d", first.AppID, first.SchemaVersion, AppID, DefaultSchemaVersion)
+	}
+
+	sent = nil
+	if err := PublishJSON(&sent, "peril_topic", "army_moves.g1.alice", "move",
+		WithMessageID("m1"), WithCorrelationID("game-g1"), WithSchemaVersion(2), WithHeader("x-game", "g1"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	meta := MetadataOf(sent[0])
+	if meta.MessageID != "m1" || meta.CorrelationID != "game-g1" || meta.SchemaVersion != 2 || sent[0].Headers["x-game"] != "g1" {
+		t.Errorf("options ignored: %+v with headers %v", meta, sent[0].Headers)
+	}
+}
+
+func TestCausedByChainsMessages(t *testing.T) {
+	var sent recorder
+	PublishJSON(&sent, "peril_direct", "rpc.move", "move")
+	move := MetadataOf(sent[0])
+	PublishJSON(&sent, "peril_topic", "war.g1.bob", "war", CausedBy(move))
+	war := MetadataOf(sent[1])
+	PublishJSON(&sent, "peril_topic", "game_logs.g1.alice", "log", CausedBy(war))
+	log := MetadataOf(sent[2])
+
+	if war.CorrelationID != move.MessageID || log.CorrelationID != move.MessageID {
+		t.Errorf("correlations %q and %q, want the move's ID %q", war.CorrelationID, log.CorrelationID, move.MessageID)
+	}
+	if war.CausationID != move.MessageID || log.CausationID != war.MessageID {
+		t.Errorf("the war was caused by %q and the log by %q, want the move and the war", war.CausationID, log.CausationID)
+	}
+}
+
+func TestDeliveryCarriesMetadata(t *testing.T) {
+	b, ch := memoryChannel(t)
+	if err := ch.ExchangeDeclare("peril_topic", ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := b.Dial()
+	defer conn.Close()
+	delivered := make(chan Delivery[string], 1)
+	sub, err := SubscribeDelivery(context.Background(), conn, "peril_topic", "moves", "army_moves.*", SimpleQueueTypeTransient, func(d Delivery[string]) Acktype {
+		delivered <- d
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	var sent recorder
+	if err := PublishJSON(&sent, "peril_topic", "army_moves.alice", "move", WithSchemaVersion(3), WithReplyTo("replies")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Publish(context.Background(), "peril_topic", "army_moves.alice", sent[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-delivered:
+		want := MetadataOf(sent[0])
+		if !d.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("timestamp %s, want %s", d.Timestamp, want.Timestamp)
+		}
+		d.Timestamp = want.Timestamp
+		if d.Metadata != want {
+			t.Errorf("delivered %+v, want %+v", d.Metadata, want)
+		}
+		if d.Body != "move" || d.ContentType != ContentTypeJSON || d.ReplyTo != "replies" || d.Exchange != "peril_topic" || d.RoutingKey != "army_moves.alice" {
+			t.Errorf("delivered %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing delivered")
+	}
+}
@@ -0,0 +1,598 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backoff controls how long a ManagedBroker waits between reconnection
+// attempts. The delay doubles on every failed attempt up to Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+var DefaultBackoff = Backoff{
+	Initial: 500 * time.Millisecond,
+	Max:     30 * time.Second,
+}
+
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Initial
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// closeNotifier is implemented by connections and channels that can tell us
+// when they die (AMQPBroker, STOMPBroker, MemoryConnection and their
+// channels).
+type closeNotifier interface {
+	// NotifyClose registers receiver to hear about the connection or
+	// channel going away, and returns it. A graceful Close closes receiver
+	// without sending an error.
+	NotifyClose(receiver chan error) chan error
+}
+
+// ManagedBroker keeps a Broker connected. When the connection drops it redials
+// with exponential backoff, then reopens every channel it handed out,
+// re-declares the exchanges, queues and bindings made on them and restarts
+// their consumers, so subscriptions keep receiving on the same deliveries
+// channel after a broker restart. While it is reconnecting, opening a channel
+// and publishing fail with ErrDisconnected rather than wait.
+type ManagedBroker struct {
+	dial    func() (Broker, error)
+	backoff Backoff
+
+	mu       sync.Mutex
+	conn     Broker
+	ready    chan struct{}
+	closed   bool
+	done     chan struct{}
+	channels map[*managedChannel]struct{}
+}
+
+// DialManaged connects to RabbitMQ at url and keeps the connection alive.
+// A stomp:// url goes through the STOMP plugin instead of AMQP.
+func DialManaged(url string, backoff Backoff) (*ManagedBroker, error) {
+	return NewManagedBroker(func() (Broker, error) {
+		if strings.HasPrefix(url, "stomp://") {
+			return DialSTOMP(url)
+		}
+		return DialAMQP(url)
+	}, backoff)
+}
+
+// NewManagedBroker calls dial once and then again every time the connection
+// is lost. The brokers it returns must support close notifications.
+func NewManagedBroker(dial func() (Broker, error), backoff Backoff) (*ManagedBroker, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := conn.(closeNotifier); !ok {
+		conn.Close()
+		return nil, errors.New("pubsub: broker does not support close notifications")
+	}
+
+	ready := make(chan struct{})
+	close(ready)
+	m := &ManagedBroker{
+		dial:     dial,
+		backoff:  backoff,
+		conn:     conn,
+		ready:    ready,
+		done:     make(chan struct{}),
+		channels: map[*managedChannel]struct{}{},
+	}
+	go m.watch(conn)
+	return m, nil
+}
+
+func (m *ManagedBroker) watch(conn Broker) {
+	for {
+		notify := conn.(closeNotifier).NotifyClose(make(chan error, 1))
+		var reason error
+		select {
+		case reason = <-notify:
+		case <-m.done:
+			return
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
+		m.conn = nil
+		m.ready = make(chan struct{})
+		m.mu.Unlock()
+		log.Printf("pubsub: connection lost (%v), reconnecting...", reason)
+
+		conn = m.redial()
+		if conn == nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.conn = conn
+		close(m.ready)
+		m.mu.Unlock()
+		log.Printf("pubsub: reconnected")
+	}
+}
+
+func (m *ManagedBroker) redial() Broker {
+	for attempt := 0; ; attempt++ {
+		conn, err := m.dial()
+		if err == nil {
+			if _, ok := conn.(closeNotifier); ok {
+				return conn
+			}
+			conn.Close()
+			err = errors.New("broker does not support close notifications")
+		}
+
+		delay := m.backoff.delay(attempt)
+		log.Printf("pubsub: reconnect attempt %d failed (%v), retrying in %v", attempt+1, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-m.done:
+			return nil
+		}
+	}
+}
+
+// connection waits until the broker is connected.
+func (m *ManagedBroker) connection(done <-chan struct{}) (Broker, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, ErrClosed
+		}
+		conn, ready := m.conn, m.ready
+		m.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+
+		select {
+		case <-ready:
+		case <-done:
+			return nil, ErrClosed
+		case <-m.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+func (m *ManagedBroker) Channel() (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if m.conn == nil {
+		return nil, ErrDisconnected
+	}
+
+	ch, err := m.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ch.(closeNotifier); !ok {
+		ch.Close()
+		return nil, errors.New("pubsub: channel does not support close notifications")
+	}
+
+	mc := &managedChannel{
+		broker: m,
+		ch:     ch,
+		done:   make(chan struct{}),
+	}
+	m.channels[mc] = struct{}{}
+	go mc.watch(ch)
+	return mc, nil
+}
+
+// inspector returns the current connection as an Inspector.
+func (m *ManagedBroker) inspector() (Inspector, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if m.conn == nil {
+		return nil, ErrDisconnected
+	}
+	insp, ok := m.conn.(Inspector)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return insp, nil
+}
+
+func (m *ManagedBroker) InspectExchange(name string) (string, bool, error) {
+	insp, err := m.inspector()
+	if err != nil {
+		return "", false, err
+	}
+	return insp.InspectExchange(name)
+}
+
+func (m *ManagedBroker) QueueExists(name string) (bool, error) {
+	insp, err := m.inspector()
+	if err != nil {
+		return false, err
+	}
+	return insp.QueueExists(name)
+}
+
+func (m *ManagedBroker) CheckQueue(name string, durable bool, args Table) error {
+	insp, err := m.inspector()
+	if err != nil {
+		return err
+	}
+	return insp.CheckQueue(name, durable, args)
+}
+
+func (m *ManagedBroker) BindingExists(queue, key, exchange string) (bool, error) {
+	insp, err := m.inspector()
+	if err != nil {
+		return false, err
+	}
+	return insp.BindingExists(queue, key, exchange)
+}
+
+func (m *ManagedBroker) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	close(m.done)
+	conn := m.conn
+	channels := m.channels
+	m.channels = nil
+	m.mu.Unlock()
+
+	for mc := range channels {
+		mc.Close()
+	}
+	// A connection that just dropped, before the watcher noticed, is
+	// already closed.
+	if conn != nil {
+		if err := conn.Close(); !errors.Is(err, ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+type managedConsumer struct {
+	queue string
+	tag   string
+	out   chan RawDelivery
+	wg    sync.WaitGroup
+}
+
+// managedOp is a declaration or setting replayed on every fresh channel.
+// Ops with the same key redo the same thing, so only the latest is kept; ops
+// with the zero key, such as server-named queues, are always kept.
+type managedOp struct {
+	key managedOpKey
+	run func(Channel) error
+}
+
+type managedOpKey struct {
+	kind, name, key, exchange string
+}
+
+// managedChannel is a Channel that survives reconnections. Everything that
+// has to be redone on a fresh channel is recorded in ops and consumers.
+type managedChannel struct {
+	broker *ManagedBroker
+
+	mu        sync.Mutex
+	ch        Channel
+	ops       []managedOp
+	consumers []*managedConsumer
+	closing   bool
+	done      chan struct{}
+}
+
+func (mc *managedChannel) current() (Channel, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closing {
+		return nil, ErrClosed
+	}
+	if mc.ch == nil {
+		return nil, ErrDisconnected
+	}
+	return mc.ch, nil
+}
+
+// do runs op on the current channel and, if it succeeds, records it under key
+// so it is replayed after a reconnection. Redeclaring something replaces its
+// record in place: retry queues are redeclared on every retry to keep them
+// from expiring, and ops must not grow with them.
+func (mc *managedChannel) do(key managedOpKey, op func(Channel) error) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closing {
+		return ErrClosed
+	}
+	if mc.ch == nil {
+		return ErrDisconnected
+	}
+	if err := op(mc.ch); err != nil {
+		return err
+	}
+	for i := range mc.ops {
+		if key != (managedOpKey{}) && mc.ops[i].key == key {
+			mc.ops[i].run = op
+			return nil
+		}
+	}
+	mc.ops = append(mc.ops, managedOp{key: key, run: op})
+	return nil
+}
+
+func (mc *managedChannel) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	return ch.Publish(ctx, exchange, key, msg)
+}
+
+func (mc *managedChannel) Confirm() error {
+	return mc.do(managedOpKey{kind: "confirm"}, func(ch Channel) error {
+		cc, ok := ch.(ConfirmChannel)
+		if !ok {
+			return errors.New("pubsub: channel does not support publisher confirms")
+		}
+		return cc.Confirm()
+	})
+}
+
+func (mc *managedChannel) PublishConfirm(ctx context.Context, exchange, key string, msg Message) (<-chan Confirmation, error) {
+	ch, err := mc.current()
+	if err != nil {
+		return nil, err
+	}
+	cc, ok := ch.(ConfirmChannel)
+	if !ok {
+		return nil, errors.New("pubsub: channel does not support publisher confirms")
+	}
+	return cc.PublishConfirm(ctx, exchange, key, msg)
+}
+
+func (mc *managedChannel) ExchangeDeclare(name, kind string, durable bool, args Table) error {
+	return mc.do(managedOpKey{kind: "exchange", name: name}, func(ch Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, args)
+	})
+}
+
+func (mc *managedChannel) QueueDeclare(name string, durable, autoDelete, exclusive bool, args Table) (Queue, error) {
+	var key managedOpKey
+	if name != "" {
+		key = managedOpKey{kind: "queue", name: name}
+	}
+	var queue Queue
+	err := mc.do(key, func(ch Channel) error {
+		q, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, args)
+		queue = q
+		return err
+	})
+	return queue, err
+}
+
+func (mc *managedChannel) QueueBind(name, key, exchange string, args Table) error {
+	return mc.do(managedOpKey{kind: "bind", name: name, key: key, exchange: exchange}, func(ch Channel) error {
+		return ch.QueueBind(name, key, exchange, args)
+	})
+}
+
+func (mc *managedChannel) Qos(prefetchCount, prefetchSize int) error {
+	return mc.do(managedOpKey{kind: "qos"}, func(ch Channel) error {
+		return ch.Qos(prefetchCount, prefetchSize)
+	})
+}
+
+func (mc *managedChannel) Consume(queue, consumer string) (<-chan RawDelivery, error) {
+	if consumer == "" {
+		consumer = newConsumerTag()
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closing {
+		return nil, ErrClosed
+	}
+	if mc.ch == nil {
+		return nil, ErrDisconnected
+	}
+
+	in, err := mc.ch.Consume(queue, consumer)
+	if err != nil {
+		return nil, err
+	}
+	c := &managedConsumer{queue: queue, tag: consumer, out: make(chan RawDelivery)}
+	mc.consumers = append(mc.consumers, c)
+	mc.forward(c, in)
+	return c.out, nil
+}
+
+// Cancel stops a consumer for good: it is not restarted after a reconnection
+// and its deliveries channel is closed.
+func (mc *managedChannel) Cancel(consumer string) error {
+	mc.mu.Lock()
+	var c *managedConsumer
+	for i, other := range mc.consumers {
+		if other.tag == consumer {
+			c = other
+			mc.consumers = append(mc.consumers[:i], mc.consumers[i+1:]...)
+			break
+		}
+	}
+	ch := mc.ch
+	mc.mu.Unlock()
+	if c == nil {
+		return fmt.Errorf("pubsub: unknown consumer %s", consumer)
+	}
+
+	var err error
+	if ch != nil {
+		err = ch.Cancel(consumer)
+	}
+	// The forwarder may still be handing over deliveries the broker sent
+	// before the cancel, so the caller has to be free to drain them.
+	go func() {
+		c.wg.Wait()
+		close(c.out)
+	}()
+	return err
+}
+
+func (mc *managedChannel) forward(c *managedConsumer, in <-chan RawDelivery) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for d := range in {
+			select {
+			case c.out <- d:
+			case <-mc.done:
+				return
+			}
+		}
+	}()
+}
+
+func (mc *managedChannel) Close() error {
+	mc.mu.Lock()
+	if mc.closing {
+		mc.mu.Unlock()
+		return ErrClosed
+	}
+	mc.closing = true
+	close(mc.done)
+	ch := mc.ch
+	mc.mu.Unlock()
+
+	var err error
+	if ch != nil {
+		err = ch.Close()
+	}
+	mc.mu.Lock()
+	consumers := mc.consumers
+	mc.consumers = nil
+	mc.mu.Unlock()
+	for _, c := range consumers {
+		c.wg.Wait()
+		close(c.out)
+	}
+
+	m := mc.broker
+	m.mu.Lock()
+	delete(m.channels, mc)
+	m.mu.Unlock()
+	return err
+}
+
+func (mc *managedChannel) watch(ch Channel) {
+	for {
+		notify := ch.(closeNotifier).NotifyClose(make(chan error, 1))
+		select {
+		case <-notify:
+		case <-mc.done:
+			return
+		}
+
+		mc.mu.Lock()
+		if mc.closing {
+			mc.mu.Unlock()
+			return
+		}
+		mc.ch = nil
+		mc.mu.Unlock()
+
+		ch = mc.reopen()
+		if ch == nil {
+			return
+		}
+	}
+}
+
+func (mc *managedChannel) reopen() Channel {
+	for attempt := 0; ; attempt++ {
+		conn, err := mc.broker.connection(mc.done)
+		if err != nil {
+			return nil
+		}
+		ch, err := mc.restore(conn)
+		if err == nil {
+			return ch
+		}
+
+		// ErrClosed means the connection is going away too; the broker's
+		// watcher will replace it, so there is nothing worth logging.
+		delay := mc.broker.backoff.delay(attempt)
+		if !errors.Is(err, ErrClosed) {
+			log.Printf("pubsub: could not restore channel (%v), retrying in %v", err, delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-mc.done:
+			return nil
+		}
+	}
+}
+
+// restore opens a channel on conn and replays the declarations, bindings and
+// consumers recorded on mc.
+func (mc *managedChannel) restore(conn Broker) (Channel, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closing {
+		return nil, ErrClosed
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ch.(closeNotifier); !ok {
+		ch.Close()
+		return nil, errors.New("channel does not support close notifications")
+	}
+	for _, op := range mc.ops {
+		if err := op.run(ch); err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+	for _, c := range mc.consumers {
+		in, err := ch.Consume(c.queue, c.tag)
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+		mc.forward(c, in)
+	}
+
+	mc.ch = ch
+	return ch, nil
+}
@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyDial dials b unless down is set, like a broker that is restarting.
+func flakyDial(b *MemoryBroker, down *atomic.Bool) func() (Broker, error) {
+	return func() (Broker, error) {
+		if down.Load() {
+			return nil, ErrConnectionForced
+		}
+		return b.Dial(), nil
+	}
+}
+
+func TestManagedBrokerRestoresAfterRestart(t *testing.T) {
+	b := NewMemoryBroker()
+	var down atomic.Bool
+	managed, err := NewManagedBroker(flakyDial(b, &down), Backoff{Initial: 5 * time.Millisecond, Max: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer managed.Close()
+
+	ch, err := managed.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing here is durable, so the restart loses all of it.
+	if err := ch.ExchangeDeclare("peril_direct", ExchangeDirect, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("pause.g1.alice", false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("pause.g1.alice", "pause.g1", "peril_direct", nil); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("pause.g1.alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishText(t, ch, "peril_direct", "pause.g1", "paused")
+	receive(t, deliveries).Ack()
+
+	down.Store(true)
+	b.Restart()
+	// While the broker is away, publishing and opening channels fail
+	// right away instead of blocking.
+	deadline := time.Now().Add(time.Second)
+	for {
+		err := ch.Publish(context.Background(), "peril_direct", "pause.g1", Message{Body: []byte("lost")})
+		if errors.Is(err, ErrDisconnected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("publishing during the restart: got %v, want ErrDisconnected", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := managed.Channel(); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("opening a channel during the restart: got %v, want ErrDisconnected", err)
+	}
+
+	down.Store(false)
+	deadline = time.Now().Add(time.Second)
+	for {
+		err := ch.Publish(context.Background(), "peril_direct", "pause.g1", Message{Body: []byte("resumed")})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrDisconnected) && !errors.Is(err, ErrClosed) {
+			t.Fatalf("publishing after the restart: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the channel never came back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The same deliveries channel gets messages again.
+	if d := receive(t, deliveries); string(d.Body) != "resumed" {
+		t.Errorf("received %q after the restart, want resumed", d.Body)
+	} else {
+		d.Ack()
+	}
+	if kind, ok, err := b.InspectExchange("peril_direct"); err != nil || !ok || kind != ExchangeDirect {
+		t.Errorf("exchange after the restart: %q, %v, %v", kind, ok, err)
+	}
+	if ok, err := b.BindingExists("pause.g1.alice", "pause.g1", "peril_direct"); err != nil || !ok {
+		t.Errorf("binding after the restart: %v, %v", ok, err)
+	}
+	if q, err := b.Queue("pause.g1.alice"); err != nil || q.Consumers != 1 {
+		t.Errorf("queue after the restart has %d consumers (%v), want 1", q.Consumers, err)
+	}
+	if _, err := managed.Channel(); err != nil {
+		t.Errorf("opening a channel after the restart: %v", err)
+	}
+}
+
+func TestManagedBrokerClose(t *testing.T) {
+	b := NewMemoryBroker()
+	var down atomic.Bool
+	managed, err := NewManagedBroker(flakyDial(b, &down), Backoff{Initial: 5 * time.Millisecond, Max: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := managed.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("pause.g1.alice", false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("pause.g1.alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing while reconnecting stops the reconnection too.
+	down.Store(true)
+	b.Restart()
+	if err := managed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Error("delivery after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deliveries still open after Close")
+	}
+	if err := ch.Publish(context.Background(), "", "pause.g1.alice", Message{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("publishing after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := managed.Channel(); !errors.Is(err, ErrClosed) {
+		t.Errorf("opening a channel after Close: got %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,994 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It understands direct,
+// topic and fanout exchanges, durable and transient queues, acks/nacks and
+// dead-lettering through the x-dead-letter-exchange argument, so whole games
+// can be played without a running server. Of the other queue arguments it
+// honours x-message-ttl, x-expires, x-max-length and x-overflow; the rest are
+// accepted and ignored.
+type MemoryBroker struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	exchanges   map[string]*memExchange
+	queues      map[string]*memQueue
+	connections map[*MemoryConnection]struct{}
+	nextID      int
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges:   map[string]*memExchange{},
+		queues:      map[string]*memQueue{},
+		connections: map[*MemoryConnection]struct{}{},
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Dial opens a new connection. Exclusive queues belong to the connection that
+// declared them and are deleted when it is closed.
+func (b *MemoryBroker) Dial() *MemoryConnection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn := &MemoryConnection{
+		broker:   b,
+		channels: map[*memChannel]struct{}{},
+	}
+	b.connections[conn] = struct{}{}
+	return conn
+}
+
+// Queue reports the number of ready messages and consumers of a queue.
+func (b *MemoryBroker) Queue(name string) (Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return Queue{}, fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	return q.info(), nil
+}
+
+// Restart simulates a broker restart: every connection is dropped and only
+// durable exchanges and queues survive.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.connections {
+		b.closeConnection(conn, ErrConnectionForced)
+	}
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueue(q)
+		}
+	}
+}
+
+// InspectExchange, QueueExists, CheckQueue and BindingExists make the broker
+// an Inspector for Topology.Diff.
+func (b *MemoryBroker) InspectExchange(name string) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ex, ok := b.exchanges[name]
+	if !ok {
+		return "", false, nil
+	}
+	return ex.kind, true, nil
+}
+
+func (b *MemoryBroker) QueueExists(name string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.queues[name]
+	return ok, nil
+}
+
+func (b *MemoryBroker) CheckQueue(name string, durable bool, args Table) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	if q.durable != durable {
+		return fmt.Errorf("%w: queue %s redeclared with different properties", ErrPreconditionFailed, name)
+	}
+	return equivalentArgs(q, args)
+}
+
+func (b *MemoryBroker) BindingExists(queue, key, exchange string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return false, nil
+	}
+	for _, bnd := range ex.bindings {
+		if bnd.queue == queue && bnd.key == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type MemoryConnection struct {
+	broker   *MemoryBroker
+	closed   bool
+	channels map[*memChannel]struct{}
+	notify   []chan error
+}
+
+func (c *MemoryConnection) Channel() (Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	ch := &memChannel{
+		conn:      c,
+		consumers: map[string]*memConsumer{},
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *MemoryConnection) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	b.closeConnection(c, nil)
+	return nil
+}
+
+func (c *MemoryConnection) NotifyClose(receiver chan error) chan error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *MemoryConnection) InspectExchange(name string) (string, bool, error) {
+	return c.broker.InspectExchange(name)
+}
+
+func (c *MemoryConnection) QueueExists(name string) (bool, error) {
+	return c.broker.QueueExists(name)
+}
+
+func (c *MemoryConnection) CheckQueue(name string, durable bool, args Table) error {
+	return c.broker.CheckQueue(name, durable, args)
+}
+
+func (c *MemoryConnection) BindingExists(queue, key, exchange string) (bool, error) {
+	return c.broker.BindingExists(queue, key, exchange)
+}
+
+type memExchange struct {
+	name     string
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+func (ex *memExchange) route(key string) []string {
+	seen := map[string]bool{}
+	queues := []string{}
+	for _, bnd := range ex.bindings {
+		if seen[bnd.queue] || !bindingMatches(ex.kind, bnd.key, key) {
+			continue
+		}
+		seen[bnd.queue] = true
+		queues = append(queues, bnd.queue)
+	}
+	return queues
+}
+
+func bindingMatches(kind, pattern, key string) bool {
+	switch kind {
+	case ExchangeFanout:
+		return true
+	case ExchangeTopic:
+		return topicMatches(topicWords(pattern), topicWords(key))
+	default:
+		return pattern == key
+	}
+}
+
+// topicWords splits a key into words. Like RabbitMQ, an empty key has none
+// rather than one empty word.
+func topicWords(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, ".")
+}
+
+// topicMatches applies AMQP topic rules: "*" is exactly one word and "#" is
+// zero or more words.
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+}
+
+type memQueue struct {
+	name        string
+	durable     bool
+	autoDelete  bool
+	exclusive   bool
+	owner       *MemoryConnection
+	args        Table
+	ready       []*memMessage
+	consumers   []*memConsumer
+	hadConsumer bool
+	deleted     bool
+	// used changes every time the queue is declared or consumed from, so an
+	// x-expires timer can tell whether the queue was used since it started.
+	used int
+}
+
+func (q *memQueue) info() Queue {
+	return Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}
+}
+
+type memMessage struct {
+	msg         Message
+	exchange    string
+	key         string
+	redelivered bool
+}
+
+func (m *memMessage) copy() *memMessage {
+	cp := *m
+	cp.msg.Headers = copyTable(m.msg.Headers)
+	return &cp
+}
+
+func copyTable(t Table) Table {
+	if t == nil {
+		return nil
+	}
+	cp := make(Table, len(t))
+	for k, v := range t {
+		cp[k] = v
+	}
+	return cp
+}
+
+type memChannel struct {
+	conn      *MemoryConnection
+	closed    bool
+	consumers map[string]*memConsumer
+	nextTag   int
+	notify    []chan error
+	prefetch  int
+	// replyTo is the queue behind ReplyToQueue once the channel consumes it.
+	replyTo string
+}
+
+type memConsumer struct {
+	tag        string
+	queue      *memQueue
+	channel    *memChannel
+	deliveries chan RawDelivery
+	done       chan struct{}
+	cancelled  bool
+	unacked    map[uint64]*memMessage
+	nextTag    uint64
+	prefetch   int
+	autoAck    bool
+}
+
+func (ch *memChannel) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return ErrClosed
+	}
+	m, err := ch.newMessage(exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	_, _, err = b.publish(m)
+	return err
+}
+
+// newMessage copies msg for publishing. A reply-to of ReplyToQueue is
+// replaced by the queue behind it, like RabbitMQ does.
+func (ch *memChannel) newMessage(exchange, key string, msg Message) (*memMessage, error) {
+	m := &memMessage{msg: msg, exchange: exchange, key: key}
+	m.msg.Headers = copyTable(msg.Headers)
+	if msg.ReplyTo == ReplyToQueue {
+		if ch.replyTo == "" {
+			return nil, fmt.Errorf("pubsub: reply-to %s used without consuming from it", ReplyToQueue)
+		}
+		m.msg.ReplyTo = ch.replyTo
+	}
+	return m, nil
+}
+
+// Confirm is a no-op: the in-memory broker knows the outcome of a publish
+// as soon as it returns.
+func (ch *memChannel) Confirm() error {
+	return nil
+}
+
+func (ch *memChannel) PublishConfirm(ctx context.Context, exchange, key string, msg Message) (<-chan Confirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, ErrClosed
+	}
+	m, err := ch.newMessage(exchange, key, msg)
+	if err != nil {
+		return nil, err
+	}
+	routed, rejected, err := b.publish(m)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(chan Confirmation, 1)
+	// A queue that refused the message (x-overflow reject-publish) nacks it.
+	c := Confirmation{Ack: rejected == 0}
+	if routed == 0 && rejected == 0 {
+		c.Returned = &Return{Exchange: exchange, RoutingKey: key, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	}
+	result <- c
+	return result, nil
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable bool, args Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return ErrClosed
+	}
+	switch kind {
+	case ExchangeDirect, ExchangeTopic, ExchangeFanout:
+	default:
+		return fmt.Errorf("pubsub: unsupported exchange kind %q", kind)
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable {
+			return fmt.Errorf("%w: exchange %s redeclared with different properties", ErrPreconditionFailed, name)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive bool, args Table) (Queue, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return Queue{}, ErrClosed
+	}
+	if name == "" {
+		b.nextID++
+		name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return Queue{}, fmt.Errorf("%w: %s", ErrResourceLocked, name)
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive {
+			return Queue{}, fmt.Errorf("%w: queue %s redeclared with different properties", ErrPreconditionFailed, name)
+		}
+		if err := equivalentArgs(q, args); err != nil {
+			return Queue{}, err
+		}
+		b.touch(q)
+		return q.info(), nil
+	}
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       copyTable(args),
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	b.touch(q)
+	return q.info(), nil
+}
+
+// queueArgs are the arguments RabbitMQ insists are the same every time a
+// queue is declared. It doesn't compare the others.
+var queueArgs = []string{
+	"x-dead-letter-exchange",
+	"x-dead-letter-routing-key",
+	"x-expires",
+	"x-max-length",
+	"x-max-length-bytes",
+	"x-max-priority",
+	"x-message-ttl",
+	"x-overflow",
+	"x-queue-type",
+	"x-single-active-consumer",
+}
+
+func equivalentArgs(q *memQueue, args Table) error {
+	for _, key := range queueArgs {
+		current, received := q.args[key], args[key]
+		if key == "x-queue-type" {
+			// Queues are classic unless they say otherwise.
+			if current == nil {
+				current = QueueTypeClassic
+			}
+			if received == nil {
+				received = QueueTypeClassic
+			}
+		}
+		if !sameArg(current, received) {
+			return fmt.Errorf("%w: inequivalent arg '%s' for queue '%s': received %s but current is %s", ErrPreconditionFailed, key, q.name, argString(received), argString(current))
+		}
+	}
+	return nil
+}
+
+// sameArg compares numbers whatever integer type they were declared with.
+func sameArg(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	x, aok := tableInt(Table{"": a}, "")
+	y, bok := tableInt(Table{"": b}, "")
+	if aok && bok {
+		return x == y
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func argString(v any) string {
+	if v == nil {
+		return "none"
+	}
+	return fmt.Sprintf("'%v'", v)
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, args Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return ErrClosed
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrExchangeNotFound, exchange)
+	}
+	if _, ok := b.queues[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	for _, bnd := range ex.bindings {
+		if bnd.queue == name && bnd.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string) (<-chan RawDelivery, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, ErrClosed
+	}
+	if queue == ReplyToQueue {
+		return ch.consumeReplies(consumer)
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrQueueNotFound, queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, fmt.Errorf("%w: %s", ErrResourceLocked, queue)
+	}
+	if consumer == "" {
+		ch.nextTag++
+		consumer = fmt.Sprintf("ctag-%d", ch.nextTag)
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, fmt.Errorf("pubsub: consumer tag %s already in use", consumer)
+	}
+	c := &memConsumer{
+		tag:        consumer,
+		queue:      q,
+		channel:    ch,
+		deliveries: make(chan RawDelivery),
+		done:       make(chan struct{}),
+		unacked:    map[uint64]*memMessage{},
+		prefetch:   ch.prefetch,
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	q.hadConsumer = true
+	b.touch(q)
+	go b.pump(c)
+	return c.deliveries, nil
+}
+
+// consumeReplies emulates direct reply-to with a hidden auto-delete queue
+// that only this channel consumes from, in auto-ack mode.
+func (ch *memChannel) consumeReplies(consumer string) (<-chan RawDelivery, error) {
+	b := ch.conn.broker
+	if ch.replyTo != "" {
+		return nil, fmt.Errorf("pubsub: channel already consumes from %s", ReplyToQueue)
+	}
+	b.nextID++
+	q := &memQueue{
+		name:       fmt.Sprintf("%s.%d", ReplyToQueue, b.nextID),
+		autoDelete: true,
+		exclusive:  true,
+		owner:      ch.conn,
+	}
+	b.queues[q.name] = q
+	if consumer == "" {
+		ch.nextTag++
+		consumer = fmt.Sprintf("ctag-%d", ch.nextTag)
+	}
+	c := &memConsumer{
+		tag:        consumer,
+		queue:      q,
+		channel:    ch,
+		deliveries: make(chan RawDelivery),
+		done:       make(chan struct{}),
+		unacked:    map[uint64]*memMessage{},
+		autoAck:    true,
+	}
+	ch.consumers[consumer] = c
+	ch.replyTo = q.name
+	q.consumers = append(q.consumers, c)
+	q.hadConsumer = true
+	go b.pump(c)
+	return c.deliveries, nil
+}
+
+// Qos limits how many unacked messages each consumer started afterwards may
+// hold. Like RabbitMQ, the size limit is not supported and must be 0.
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return ErrClosed
+	}
+	if prefetchSize != 0 {
+		return errors.New("pubsub: prefetch size is not supported")
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memChannel) Cancel(consumer string) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return ErrClosed
+	}
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		return fmt.Errorf("pubsub: unknown consumer %s", consumer)
+	}
+	b.cancelConsumer(c)
+	return nil
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return ErrClosed
+	}
+	b.closeChannel(ch, nil)
+	return nil
+}
+
+func (ch *memChannel) NotifyClose(receiver chan error) chan error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+	ch.notify = append(ch.notify, receiver)
+	return receiver
+}
+
+// full reports whether the consumer has as many unacked messages as its
+// prefetch count allows.
+func (c *memConsumer) full() bool {
+	return c.prefetch > 0 && len(c.unacked) >= c.prefetch
+}
+
+// pump hands ready messages of the consumer's queue to its deliveries channel.
+func (b *MemoryBroker) pump(c *memConsumer) {
+	defer close(c.deliveries)
+	for {
+		b.mu.Lock()
+		for !c.cancelled && (len(c.queue.ready) == 0 || c.full()) {
+			b.cond.Wait()
+		}
+		if c.cancelled {
+			b.mu.Unlock()
+			return
+		}
+		m := c.queue.ready[0]
+		c.queue.ready = c.queue.ready[1:]
+		c.nextTag++
+		tag := c.nextTag
+		d := RawDelivery{
+			Message:     m.msg,
+			Exchange:    m.exchange,
+			RoutingKey:  m.key,
+			Redelivered: m.redelivered,
+			acker:       memAcker{consumer: c, tag: tag},
+		}
+		if c.autoAck {
+			d.acker = autoAcker{}
+		} else {
+			c.unacked[tag] = m
+		}
+		b.mu.Unlock()
+
+		select {
+		case c.deliveries <- d:
+		case <-c.done:
+			b.mu.Lock()
+			if m, ok := c.unacked[tag]; ok {
+				delete(c.unacked, tag)
+				b.requeue(c.queue, m)
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+type memAcker struct {
+	consumer *memConsumer
+	tag      uint64
+}
+
+func (a memAcker) Ack() error {
+	b := a.consumer.channel.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := a.take(); err != nil {
+		return err
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func (a memAcker) Nack(requeue bool) error {
+	b := a.consumer.channel.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, err := a.take()
+	if err != nil {
+		return err
+	}
+	if requeue {
+		b.requeue(a.consumer.queue, m)
+	} else {
+		b.deadLetter(a.consumer.queue, m, "rejected")
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func (a memAcker) take() (*memMessage, error) {
+	if a.consumer.channel.closed {
+		return nil, ErrClosed
+	}
+	m, ok := a.consumer.unacked[a.tag]
+	if !ok {
+		return nil, fmt.Errorf("pubsub: unknown delivery tag %d", a.tag)
+	}
+	delete(a.consumer.unacked, a.tag)
+	return m, nil
+}
+
+// The helpers below expect b.mu to be held.
+
+// publish routes m and reports how many queues took it and how many turned it
+// away because they were full.
+func (b *MemoryBroker) publish(m *memMessage) (routed, rejected int, err error) {
+	if m.exchange == "" {
+		q, ok := b.queues[m.key]
+		if !ok {
+			return 0, 0, nil
+		}
+		if !b.enqueue(q, m) {
+			return 0, 1, nil
+		}
+		return 1, 0, nil
+	}
+	ex, ok := b.exchanges[m.exchange]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %s", ErrExchangeNotFound, m.exchange)
+	}
+	for _, name := range ex.route(m.key) {
+		if q, ok := b.queues[name]; ok {
+			if b.enqueue(q, m.copy()) {
+				routed++
+			} else {
+				rejected++
+			}
+		}
+	}
+	return routed, rejected, nil
+}
+
+// enqueue adds m to q, or reports false if q is at its x-max-length and
+// rejects new messages.
+func (b *MemoryBroker) enqueue(q *memQueue, m *memMessage) bool {
+	if max, ok := tableInt(q.args, "x-max-length"); ok && int64(len(q.ready)) >= max {
+		switch q.args["x-overflow"] {
+		case OverflowRejectPublish:
+			return false
+		case OverflowRejectPublishDLX:
+			b.deadLetter(q, m, "maxlen")
+			return false
+		}
+		// drop-head: make room by dead-lettering the oldest messages.
+		for int64(len(q.ready)) >= max && len(q.ready) > 0 {
+			head := q.ready[0]
+			q.ready = q.ready[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+		if max == 0 {
+			b.deadLetter(q, m, "maxlen")
+			return true
+		}
+	}
+	q.ready = append(q.ready, m)
+	if ttl, ok := tableInt(q.args, "x-message-ttl"); ok {
+		time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.expire(q, m)
+		})
+	}
+	b.cond.Broadcast()
+	return true
+}
+
+// touch marks q as used and, if it has an x-expires argument, deletes it
+// once it has gone that long without consumers or redeclarations.
+func (b *MemoryBroker) touch(q *memQueue) {
+	q.used++
+	expires, ok := tableInt(q.args, "x-expires")
+	if !ok {
+		return
+	}
+	used := q.used
+	time.AfterFunc(time.Duration(expires)*time.Millisecond, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if q.used == used && len(q.consumers) == 0 {
+			b.deleteQueue(q)
+		}
+	})
+}
+
+// expire dead-letters m if it is still waiting in q when its TTL runs out.
+// Messages already handed to a consumer don't expire.
+func (b *MemoryBroker) expire(q *memQueue, m *memMessage) {
+	for i, ready := range q.ready {
+		if ready == m {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			b.deadLetter(q, m, "expired")
+			return
+		}
+	}
+}
+
+func (b *MemoryBroker) requeue(q *memQueue, m *memMessage) {
+	if q.deleted {
+		return
+	}
+	m.redelivered = true
+	q.ready = append([]*memMessage{m}, q.ready...)
+	b.cond.Broadcast()
+}
+
+// deadLetter republishes a message to the queue's dead-letter exchange, if it
+// has one, recording why in the x-death header like RabbitMQ does.
+func (b *MemoryBroker) deadLetter(q *memQueue, m *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	if _, ok := b.exchanges[dlx]; !ok && dlx != "" {
+		return
+	}
+	key := m.key
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+
+	dead := m.copy()
+	if dead.msg.Headers == nil {
+		dead.msg.Headers = Table{}
+	}
+	dead.msg.Headers["x-death"] = appendDeath(dead.msg.Headers["x-death"], q.name, reason, m)
+	dead.exchange = dlx
+	dead.key = key
+	dead.redelivered = false
+	b.publish(dead)
+}
+
+func appendDeath(existing any, queue, reason string, m *memMessage) []any {
+	deaths, _ := existing.([]any)
+	for i, d := range deaths {
+		t, ok := d.(Table)
+		if !ok || t["queue"] != queue || t["reason"] != reason {
+			continue
+		}
+		t = copyTable(t)
+		count, _ := t["count"].(int64)
+		t["count"] = count + 1
+		t["time"] = time.Now()
+		out := append([]any{t}, deaths[:i]...)
+		return append(out, deaths[i+1:]...)
+	}
+	death := Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"exchange":     m.exchange,
+		"routing-keys": []any{m.key},
+		"time":         time.Now(),
+	}
+	return append([]any{death}, deaths...)
+}
+
+func (b *MemoryBroker) cancelConsumer(c *memConsumer) {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	delete(c.channel.consumers, c.tag)
+
+	q := c.queue
+	if c.channel.replyTo == q.name {
+		c.channel.replyTo = ""
+	}
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.autoDelete && q.hadConsumer && len(q.consumers) == 0 {
+		b.deleteQueue(q)
+	} else if len(q.consumers) == 0 {
+		b.touch(q)
+	}
+	b.cond.Broadcast()
+}
+
+func (b *MemoryBroker) closeChannel(ch *memChannel, reason error) {
+	for _, c := range ch.consumers {
+		b.cancelConsumer(c)
+		for tag, m := range c.unacked {
+			delete(c.unacked, tag)
+			b.requeue(c.queue, m)
+		}
+	}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+	notifyClosed(ch.notify, reason)
+	ch.notify = nil
+}
+
+func (b *MemoryBroker) closeConnection(conn *MemoryConnection, reason error) {
+	for ch := range conn.channels {
+		b.closeChannel(ch, reason)
+	}
+	for _, q := range b.queues {
+		if q.exclusive && q.owner == conn {
+			b.deleteQueue(q)
+		}
+	}
+	conn.closed = true
+	delete(b.connections, conn)
+	notifyClosed(conn.notify, reason)
+	conn.notify = nil
+}
+
+func notifyClosed(receivers []chan error, reason error) {
+	for _, r := range receivers {
+		if reason != nil {
+			select {
+			case r <- reason:
+			default:
+			}
+		}
+		close(r)
+	}
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	if q.deleted {
+		return
+	}
+	q.deleted = true
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, bnd := range ex.bindings {
+			if bnd.queue != q.name {
+				bindings = append(bindings, bnd)
+			}
+		}
+		ex.bindings = bindings
+	}
+	for _, c := range append([]*memConsumer{}, q.consumers...) {
+		b.cancelConsumer(c)
+	}
+	q.ready = nil
+}
@@ -0,0 +1,236 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTopicMatches(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.g1.alice", false},
+		{"army_moves.*.*", "army_moves.g1.alice", true},
+		{"*.g1.*", "war.g1.bob", true},
+		{"*", "", false},
+		{"*", "alice", true},
+		{"#", "", true},
+		{"#", "army_moves.g1.alice", true},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.g1.alice", true},
+		{"game_logs.#.alice", "game_logs.alice", true},
+		{"game_logs.#.alice", "game_logs.g1.bob", false},
+		{"#.#", "", true},
+		{"", "", true},
+		{"", "alice", false},
+		{"a.*.b", "a..b", true},
+		{"a..b", "a..b", true},
+		{"pause.g1", "pause.g2", false},
+	} {
+		if got := bindingMatches(ExchangeTopic, tt.pattern, tt.key); got != tt.want {
+			t.Errorf("%q matches %q = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan RawDelivery) RawDelivery {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery")
+	}
+	return RawDelivery{}
+}
+
+func expectNothing(t *testing.T, deliveries <-chan RawDelivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected delivery %q", d.Body)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func memoryChannel(t *testing.T) (*MemoryBroker, Channel) {
+	t.Helper()
+	b := NewMemoryBroker()
+	conn := b.Dial()
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, ch
+}
+
+func publishText(t *testing.T, ch Channel, exchange, key, body string) {
+	t.Helper()
+	if err := ch.Publish(context.Background(), exchange, key, Message{Body: []byte(body)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryAckNackRequeue(t *testing.T) {
+	b, ch := memoryChannel(t)
+	if _, err := ch.QueueDeclare("moves", false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Qos(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("moves", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishText(t, ch, "", "moves", "a")
+	publishText(t, ch, "", "moves", "b")
+
+	first := receive(t, deliveries)
+	if string(first.Body) != "a" || first.Redelivered {
+		t.Fatalf("got %q redelivered=%v, want a fresh a", first.Body, first.Redelivered)
+	}
+	// The prefetch of 1 holds b back until a is settled.
+	expectNothing(t, deliveries)
+
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+	again := receive(t, deliveries)
+	if string(again.Body) != "a" || !again.Redelivered {
+		t.Fatalf("got %q redelivered=%v, want a redelivered", again.Body, again.Redelivered)
+	}
+	if err := again.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Ack(); err == nil {
+		t.Error("acking a delivery twice succeeded")
+	}
+
+	second := receive(t, deliveries)
+	if string(second.Body) != "b" {
+		t.Fatalf("got %q, want b", second.Body)
+	}
+	// Without a dead-letter exchange a rejected message is gone.
+	if err := second.Nack(false); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, deliveries)
+	if q, err := b.Queue("moves"); err != nil || q.Messages != 0 {
+		t.Errorf("queue left with %d messages (%v), want none", q.Messages, err)
+	}
+}
+
+func TestMemoryDeadLettering(t *testing.T) {
+	_, ch := memoryChannel(t)
+	if err := ch.ExchangeDeclare(DeadLetterExchange, ExchangeFanout, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("dlq", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("dlq", "", DeadLetterExchange, nil); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := ch.Consume("dlq", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	declare := func(name string, args Table) {
+		args["x-dead-letter-exchange"] = DeadLetterExchange
+		if _, err := ch.QueueDeclare(name, true, false, false, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantDeath := func(body, queue, reason string) {
+		t.Helper()
+		d := receive(t, dead)
+		deaths := Deaths(d.Headers)
+		if string(d.Body) != body || len(deaths) != 1 || deaths[0].Queue != queue || deaths[0].Reason != reason || deaths[0].Count != 1 {
+			t.Fatalf("dead-lettered %q with %+v, want %q from %s because %s", d.Body, deaths, body, queue, reason)
+		}
+		if len(deaths[0].RoutingKeys) != 1 || deaths[0].RoutingKeys[0] != queue {
+			t.Errorf("x-death routing keys %v, want [%s]", deaths[0].RoutingKeys, queue)
+		}
+		d.Ack()
+	}
+
+	declare("ttl", Table{"x-message-ttl": int64(10)})
+	publishText(t, ch, "", "ttl", "stale")
+	wantDeath("stale", "ttl", "expired")
+
+	declare("short", Table{"x-max-length": int64(1)})
+	publishText(t, ch, "", "short", "oldest")
+	publishText(t, ch, "", "short", "newest")
+	wantDeath("oldest", "short", "maxlen")
+
+	declare("rejects", Table{})
+	deliveries, err := ch.Consume("rejects", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishText(t, ch, "", "rejects", "bad")
+	receive(t, deliveries).Nack(false)
+	wantDeath("bad", "rejects", "rejected")
+}
+
+func TestMemoryQueueExpires(t *testing.T) {
+	b, ch := memoryChannel(t)
+	if _, err := ch.QueueDeclare("pause.g1.alice.retry.10ms", false, false, false, Table{"x-expires": int64(20)}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := b.Queue("pause.g1.alice.retry.10ms"); errors.Is(err, ErrQueueNotFound) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unused queue did not expire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMemoryRedeclareQueue(t *testing.T) {
+	_, ch := memoryChannel(t)
+	args := Table{"x-message-ttl": int64(5000), "x-dead-letter-exchange": ""}
+	if _, err := ch.QueueDeclare("rpc.spawn", true, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		args Table
+		ok   bool
+	}{
+		{"same arguments", Table{"x-message-ttl": int64(5000), "x-dead-letter-exchange": ""}, true},
+		{"same TTL as another integer type", Table{"x-message-ttl": 5000, "x-dead-letter-exchange": ""}, true},
+		{"explicitly classic", Table{"x-message-ttl": int64(5000), "x-dead-letter-exchange": "", "x-queue-type": QueueTypeClassic}, true},
+		{"arguments RabbitMQ doesn't compare", Table{"x-message-ttl": int64(5000), "x-dead-letter-exchange": "", "x-peril": "yes"}, true},
+		{"different TTL", Table{"x-message-ttl": int64(10000), "x-dead-letter-exchange": ""}, false},
+		{"no TTL", Table{"x-dead-letter-exchange": ""}, false},
+		{"different dead-letter exchange", Table{"x-message-ttl": int64(5000), "x-dead-letter-exchange": DeadLetterExchange}, false},
+		{"quorum", Table{"x-message-ttl": int64(5000), "x-dead-letter-exchange": "", "x-queue-type": QueueTypeQuorum}, false},
+	} {
+		_, err := ch.QueueDeclare("rpc.spawn", true, false, false, tt.args)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: got %v, want ErrPreconditionFailed", tt.name, err)
+		}
+	}
+
+	if _, err := ch.QueueDeclare("rpc.spawn", false, false, false, args); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("redeclaring a durable queue as transient: got %v, want ErrPreconditionFailed", err)
+	}
+}
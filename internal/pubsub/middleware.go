@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Handler handles one decoded message and says what to do with it.
+type Handler[T any] func(Delivery[T]) Acktype
+
+// Middleware wraps a Handler with behaviour shared by many handlers.
+type Middleware[T any] func(Handler[T]) Handler[T]
+
+// Chain wraps h so the first middleware is the outermost:
+// Chain(h, Recover, Logging) recovers panics raised by Logging too.
+func Chain[T any](h Handler[T], middleware ...Middleware[T]) Handler[T] {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// BodyHandler adapts a handler that only wants the message body, as passed
+// to Subscribe, so middleware can be chained onto it:
+//
+//	pubsub.Chain(pubsub.BodyHandler(handlerPause(gs)), pubsub.Recover)
+func BodyHandler[T any](fn func(T) Acktype) Handler[T] {
+	return func(d Delivery[T]) Acktype {
+		return fn(d.Body)
+	}
+}
+
+// Recover turns a panicking handler into a NackRetry, so the message goes
+// through the retry policy (and is dead-lettered eventually) instead of
+// killing the consumer with the message unacked.
+func Recover[T any](next Handler[T]) Handler[T] {
+	return func(d Delivery[T]) (acktype Acktype) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("pubsub: handler for %s panicked: %v\n%s", d.RoutingKey, r, debug.Stack())
+				acktype = NackRetry
+			}
+		}()
+		return next(d)
+	}
+}
+
+// Logging logs every message and what the handler decided.
+func Logging[T any](next Handler[T]) Handler[T] {
+	return func(d Delivery[T]) Acktype {
+		start := time.Now()
+		acktype := next(d)
+		log.Printf("pubsub: %s %s -> %s (%s)", d.RoutingKey, d.MessageID, acktype, time.Since(start).Round(time.Millisecond))
+		return acktype
+	}
+}
+
+// Timing reports how long every message took to handle.
+func Timing[T any](observe func(d Delivery[T], took time.Duration, acktype Acktype)) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) Acktype {
+			start := time.Now()
+			acktype := next(d)
+			observe(d, time.Since(start), acktype)
+			return acktype
+		}
+	}
+}
+
+// Timeout gives the handler d of time through d.Context(). A handler that
+// hasn't returned by then gets its message retried; it should watch the
+// context and give up, since it otherwise keeps running in the background.
+func Timeout[T any](d time.Duration) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Delivery[T]) Acktype {
+			ctx, cancel := context.WithTimeout(msg.Context(), d)
+			defer cancel()
+
+			// A panic in the handler's goroutine is raised again here, so
+			// Recover still sees it.
+			result := make(chan Acktype, 1)
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						panicked <- r
+					}
+				}()
+				result <- next(msg.WithContext(ctx))
+			}()
+			select {
+			case acktype := <-result:
+				return acktype
+			case r := <-panicked:
+				panic(r)
+			case <-ctx.Done():
+				log.Printf("pubsub: handler for %s timed out after %s", msg.RoutingKey, d)
+				return NackRetry
+			}
+		}
+	}
+}
+
+// ErrDiscard marks an error that retrying won't fix, see HandleErr.
+var ErrDiscard = errors.New("pubsub: discard message")
+
+// Discard wraps err so HandleErr drops the message instead of retrying it.
+func Discard(err error) error {
+	return fmt.Errorf("%w: %w", ErrDiscard, err)
+}
+
+// HandleErr adapts a handler that returns an error: nil acks the message,
+// errors wrapped with Discard drop it and anything else retries it.
+func HandleErr[T any](fn func(Delivery[T]) error) Handler[T] {
+	return func(d Delivery[T]) Acktype {
+		err := fn(d)
+		switch {
+		case err == nil:
+			return Ack
+		case errors.Is(err, ErrDiscard):
+			log.Printf("pubsub: discarding %s: %s", d.RoutingKey, err)
+			return NackDiscard
+		default:
+			log.Printf("pubsub: retrying %s: %s", d.RoutingKey, err)
+			return NackRetry
+		}
+	}
+}
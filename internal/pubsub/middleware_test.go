@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	named := func(name string) Middleware[string] {
+		return func(next Handler[string]) Handler[string] {
+			return func(d Delivery[string]) Acktype {
+				calls = append(calls, name)
+				return next(d)
+			}
+		}
+	}
+	h := Chain(BodyHandler(func(string) Acktype {
+		calls = append(calls, "handler")
+		return Ack
+	}), named("outer"), named("inner"))
+	h(Delivery[string]{})
+	if got := strings.Join(calls, " "); got != "outer inner handler" {
+		t.Errorf("called %s, want outer inner handler", got)
+	}
+}
+
+func TestRecoverRetriesPanics(t *testing.T) {
+	panicky := func(Delivery[string]) Acktype { panic("bad move") }
+	if got := Chain(panicky, Recover[string])(Delivery[string]{}); got != NackRetry {
+		t.Errorf("got %s, want NackRetry", got)
+	}
+	// Timeout runs the handler on its own goroutine and passes the panic on.
+	if got := Chain(panicky, Recover[string], Timeout[string](time.Second))(Delivery[string]{}); got != NackRetry {
+		t.Errorf("under Timeout: got %s, want NackRetry", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	gaveUp := make(chan error, 1)
+	slow := Chain(func(d Delivery[string]) Acktype {
+		<-d.Context().Done()
+		gaveUp <- d.Context().Err()
+		return Ack
+	}, Timeout[string](20*time.Millisecond))
+
+	start := time.Now()
+	if got := slow(Delivery[string]{}); got != NackRetry {
+		t.Errorf("got %s, want NackRetry", got)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("gave up after %s", took)
+	}
+	select {
+	case err := <-gaveUp:
+		if err == nil {
+			t.Error("the handler's context was not cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Error("the handler never saw its context end")
+	}
+
+	fast := Chain(BodyHandler(func(string) Acktype { return NackDiscard }), Timeout[string](time.Second))
+	if got := fast(Delivery[string]{}); got != NackDiscard {
+		t.Errorf("handler in time: got %s, want its own NackDiscard", got)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	var took time.Duration
+	var acked Acktype
+	h := Chain(func(Delivery[string]) Acktype {
+		time.Sleep(5 * time.Millisecond)
+		return NackRequeue
+	}, Timing(func(_ Delivery[string], d time.Duration, acktype Acktype) {
+		took, acked = d, acktype
+	}))
+	h(Delivery[string]{})
+	if took < 5*time.Millisecond || acked != NackRequeue {
+		t.Errorf("observed %s and %s, want at least 5ms and NackRequeue", took, acked)
+	}
+}
+
+func TestHandleErr(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want Acktype
+	}{
+		{nil, Ack},
+		{errors.New("database is down"), NackRetry},
+		{Discard(errors.New("no such unit")), NackDiscard},
+	} {
+		h := HandleErr(func(Delivery[string]) error { return tt.err })
+		if got := h(Delivery[string]{}); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+// SubscribeOption tunes a subscription created by Subscribe.
+type SubscribeOption func(*subscribeOptions)
+
+// DefaultPrefetchCount is how many unacked messages the broker sends a
+// subscription before waiting for acks. Binaries may change it from their
+// configuration before subscribing to anything.
+var DefaultPrefetchCount = 10
+
+type subscribeOptions struct {
+	onPoison      PoisonHandler
+	retry         *RetryPolicy
+	prefetchCount int
+	prefetchSize  int
+	workers       int
+	orderingKey   func(RawDelivery) string
+	queue         []QueueOption
+	sealKeys      *SealKeys
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	o := subscribeOptions{
+		prefetchCount: DefaultPrefetchCount,
+		workers:       1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// OnPoison registers a callback for deliveries that could not be decoded. It
+// runs after the message has been dead-lettered.
+func OnPoison(fn PoisonHandler) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onPoison = fn
+	}
+}
+
+// WithRetry sets how NackRetry behaves for this subscription. Without it
+// DefaultRetryPolicy is used.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+// WithPrefetch sets the channel's prefetch. A count of 0 means no limit.
+// RabbitMQ does not implement the size limit, so keep it at 0 there.
+func WithPrefetch(count, size int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetchCount = count
+		o.prefetchSize = size
+	}
+}
+
+// WithWorkers runs the handler on n goroutines. The prefetch count should be
+// at least n or some workers will sit idle.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if n < 1 {
+			n = 1
+		}
+		o.workers = n
+	}
+}
+
+// WithOrderingKey keeps messages that share a key in order when there are
+// several workers; messages with different keys are still handled in
+// parallel. See ByRoutingKey.
+func WithOrderingKey(key func(RawDelivery) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderingKey = key
+	}
+}
+
+// WithQueueOptions passes opts on to DeclareAndBind when the subscription's
+// queue is declared.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queue = append(o.queue, opts...)
+	}
+}
@@ -0,0 +1,340 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outbox makes publishing durable. Messages are appended to a file and
+// fsynced before Publish returns, then a background relay sends them to the
+// broker in order, retrying with backoff until each one is confirmed. Messages
+// that were not relayed yet are picked up again when the outbox is reopened.
+// A crash right after a send can relay a message twice; it keeps its message
+// ID, so Deduplicate catches that on the other end.
+//
+// Outbox is a Publisher, so PublishJSON and friends can write to it.
+type Outbox struct {
+	publisher Publisher
+	// Backoff paces the relay's retries while the broker is unreachable.
+	Backoff Backoff
+
+	mu      sync.Mutex
+	file    *os.File
+	pending []outboxRecord
+	nextSeq uint64
+	drained chan struct{}
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// outboxRecord is one line of the outbox file: either a message to relay or
+// the note that message Seq was relayed.
+type outboxRecord struct {
+	Seq      uint64   `json:"seq"`
+	Done     bool     `json:"done,omitempty"`
+	Exchange string   `json:"exchange,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Message  *Message `json:"message,omitempty"`
+}
+
+// OpenOutbox opens (or creates) the outbox file at path and starts relaying
+// to publisher. Use a ConfirmingPublisher, or the relay can't tell whether
+// the broker really got a message.
+func OpenOutbox(path string, publisher Publisher) (*Outbox, error) {
+	o := &Outbox{
+		publisher: publisher,
+		Backoff:   DefaultBackoff,
+		nextSeq:   1,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := o.load(path); err != nil {
+		return nil, err
+	}
+
+	var err error
+	o.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	go o.relay()
+	return o, nil
+}
+
+// load reads back the messages that were never marked done.
+func (o *Outbox) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	relayed := map[uint64]bool{}
+	var puts []outboxRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec outboxRecord
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&rec); err != nil {
+			// A torn last line from a crash mid-write was never
+			// acknowledged to the caller, so it can be dropped.
+			log.Printf("pubsub: skipping bad outbox record in %s: %s", path, err)
+			continue
+		}
+		if rec.Seq >= o.nextSeq {
+			o.nextSeq = rec.Seq + 1
+		}
+		if rec.Done {
+			relayed[rec.Seq] = true
+			continue
+		}
+		if rec.Message != nil {
+			rec.Message.Headers = fromJSONTable(rec.Message.Headers)
+		}
+		puts = append(puts, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	for _, rec := range puts {
+		if !relayed[rec.Seq] {
+			o.pending = append(o.pending, rec)
+		}
+	}
+	return nil
+}
+
+// fromJSONTable turns the json.Numbers of a decoded Table back into int64 or
+// float64, the types the transports expect.
+func fromJSONTable(t Table) Table {
+	for k, v := range t {
+		t[k] = fromJSONValue(v)
+	}
+	return t
+}
+
+func fromJSONValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		return fromJSONTable(Table(v))
+	case []any:
+		for i := range v {
+			v[i] = fromJSONValue(v[i])
+		}
+	}
+	return v
+}
+
+// Publish records msg in the outbox. Once it returns nil the message will
+// reach the broker eventually, even if this process crashes first.
+func (o *Outbox) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	return o.append([]outboxRecord{{Exchange: exchange, Key: key, Message: &msg}})
+}
+
+// Transaction runs fn, which publishes the messages announcing a state change
+// to tx, and records them all together if fn returns nil. It doesn't touch
+// the state itself: make the change only once Transaction returns nil, or
+// undo it if Transaction fails, so it is never made without being announced.
+func (o *Outbox) Transaction(fn func(tx Publisher) error) error {
+	tx := &outboxTx{}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return o.append(tx.records)
+}
+
+type outboxTx struct {
+	records []outboxRecord
+}
+
+func (tx *outboxTx) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	tx.records = append(tx.records, outboxRecord{Exchange: exchange, Key: key, Message: &msg})
+	return nil
+}
+
+func (o *Outbox) append(records []outboxRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil {
+		return ErrClosed
+	}
+
+	var buf bytes.Buffer
+	seq := o.nextSeq
+	for i := range records {
+		records[i].Seq = seq
+		seq++
+		line, err := json.Marshal(records[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if _, err := o.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := o.file.Sync(); err != nil {
+		return err
+	}
+	o.nextSeq = seq
+	o.pending = append(o.pending, records...)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending is the number of messages waiting to be relayed.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Flush waits until every recorded message has been relayed.
+func (o *Outbox) Flush(ctx context.Context) error {
+	for {
+		o.mu.Lock()
+		if len(o.pending) == 0 {
+			o.mu.Unlock()
+			return nil
+		}
+		if o.drained == nil {
+			o.drained = make(chan struct{})
+		}
+		drained := o.drained
+		o.mu.Unlock()
+
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-o.done:
+			return ErrClosed
+		}
+	}
+}
+
+func (o *Outbox) next() (outboxRecord, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return outboxRecord{}, false
+	}
+	return o.pending[0], true
+}
+
+func (o *Outbox) relay() {
+	defer close(o.done)
+	attempt := 0
+	for {
+		rec, ok := o.next()
+		if !ok {
+			select {
+			case <-o.wake:
+				continue
+			case <-o.stop:
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultConfirmTimeout)
+		err := o.publisher.Publish(ctx, rec.Exchange, rec.Key, *rec.Message)
+		cancel()
+		// Nobody was listening; retrying won't change that.
+		var unroutable *UnroutableError
+		if errors.As(err, &unroutable) {
+			err = nil
+		}
+		if err != nil {
+			delay := o.Backoff.delay(attempt)
+			attempt++
+			log.Printf("pubsub: could not relay outbox message %d, retrying in %s: %s", rec.Seq, delay, err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-o.stop:
+				return
+			}
+		}
+		attempt = 0
+		if err := o.markDone(rec.Seq); err != nil {
+			log.Printf("pubsub: could not mark outbox message %d as relayed: %s", rec.Seq, err)
+		}
+	}
+}
+
+// markDone drops the first pending message. Once nothing is pending the file
+// is truncated, which keeps it from growing forever.
+func (o *Outbox) markDone(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = o.pending[1:]
+	if len(o.pending) == 0 && o.drained != nil {
+		close(o.drained)
+		o.drained = nil
+	}
+	if o.file == nil {
+		return ErrClosed
+	}
+
+	if len(o.pending) == 0 {
+		return o.file.Truncate(0)
+	}
+	line, err := json.Marshal(outboxRecord{Seq: seq, Done: true})
+	if err != nil {
+		return err
+	}
+	_, err = o.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close stops the relay. Messages it didn't get to stay in the file.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	if o.file == nil {
+		o.mu.Unlock()
+		return ErrClosed
+	}
+	o.mu.Unlock()
+
+	close(o.stop)
+	<-o.done
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
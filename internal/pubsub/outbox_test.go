@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokerStandIn takes what the outbox relays one message at a time: the
+// relay waits in Publish until the test reads the message from sent. With
+// down set it refuses everything instead.
+type brokerStandIn struct {
+	down bool
+	sent chan Message
+}
+
+func (b *brokerStandIn) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	if b.down {
+		return ErrDisconnected
+	}
+	select {
+	case b.sent <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func openTestOutbox(t *testing.T, path string, pub Publisher) *Outbox {
+	t.Helper()
+	o, err := OpenOutbox(path, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Backoff = Backoff{Initial: time.Millisecond, Max: time.Millisecond}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func expectRelayed(t *testing.T, b *brokerStandIn, bodies ...string) []Message {
+	t.Helper()
+	var msgs []Message
+	for _, want := range bodies {
+		select {
+		case msg := <-b.sent:
+			if string(msg.Body) != want {
+				t.Fatalf("relayed %q, want %q", msg.Body, want)
+			}
+			msgs = append(msgs, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("%q was never relayed", want)
+		}
+	}
+	return msgs
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func textMessage(body string) Message {
+	return Message{ContentType: "text/plain", Body: []byte(body)}
+}
+
+func TestOutboxSkipsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	var lines []string
+	for _, rec := range []outboxRecord{
+		{Seq: 1, Exchange: "peril_topic", Key: "game_logs.g1.alice", Message: &Message{Body: []byte("one")}},
+		{Seq: 2, Exchange: "peril_topic", Key: "game_logs.g1.alice", Message: &Message{Body: []byte("two")}},
+		{Seq: 2, Done: true},
+	} {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	// The process died writing the third record.
+	data := strings.Join(lines, "\n") + "\n" + `{"seq":3,"exchange":"peril_top`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &brokerStandIn{sent: make(chan Message)}
+	o := openTestOutbox(t, path, b)
+	if err := o.Publish(context.Background(), "peril_topic", "game_logs.g1.alice", textMessage("three")); err != nil {
+		t.Fatal(err)
+	}
+	expectRelayed(t, b, "one", "three")
+}
+
+func TestOutboxMarksDoneThenTruncates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	b := &brokerStandIn{sent: make(chan Message)}
+	o := openTestOutbox(t, path, b)
+	for _, body := range []string{"one", "two"} {
+		if err := o.Publish(context.Background(), "peril_topic", "game_logs.g1.alice", textMessage(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With "two" still pending, "one" is marked done in the file.
+	expectRelayed(t, b, "one")
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), `{"seq":1,"done":true}`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message 1 never marked done:\n%s", data)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := o.Pending(); n != 1 {
+		t.Errorf("%d messages pending, want 1", n)
+	}
+
+	expectRelayed(t, b, "two")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := o.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, path); size != 0 {
+		t.Errorf("outbox file is %d bytes with nothing pending, want it truncated", size)
+	}
+}
+
+func TestOutboxTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	b := &brokerStandIn{sent: make(chan Message)}
+	o := openTestOutbox(t, path, b)
+
+	failed := errors.New("the move is illegal")
+	err := o.Transaction(func(tx Publisher) error {
+		if err := tx.Publish(context.Background(), "peril_topic", "army_moves.g1.alice", textMessage("half a move")); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("Transaction returned %v, want fn's error", err)
+	}
+	if n, size := o.Pending(), fileSize(t, path); n != 0 || size != 0 {
+		t.Fatalf("a failed transaction left %d pending messages and %d bytes", n, size)
+	}
+
+	err = o.Transaction(func(tx Publisher) error {
+		for _, body := range []string{"move", "war", "log"} {
+			if err := tx.Publish(context.Background(), "peril_topic", "army_moves.g1.alice", textMessage(body)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRelayed(t, b, "move", "war", "log")
+}
+
+func TestOutboxReplaysAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	down := &brokerStandIn{down: true}
+	o := openTestOutbox(t, path, down)
+	var ids []string
+	for _, body := range []string{"one", "two"} {
+		msg := textMessage(body)
+		msg.MessageID = NewMessageID()
+		msg.Headers = Table{HeaderRetryCount: int64(2)}
+		ids = append(ids, msg.MessageID)
+		if err := o.Publish(context.Background(), "peril_topic", "game_logs.g1.alice", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	up := &brokerStandIn{sent: make(chan Message)}
+	openTestOutbox(t, path, up)
+	for i, msg := range expectRelayed(t, up, "one", "two") {
+		if msg.MessageID != ids[i] {
+			t.Errorf("message %d relayed with ID %s, want %s", i+1, msg.MessageID, ids[i])
+		}
+		if n, ok := msg.Headers[HeaderRetryCount].(int64); !ok || n != 2 {
+			t.Errorf("message %d relayed with %s %#v, want int64(2)", i+1, HeaderRetryCount, msg.Headers[HeaderRetryCount])
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// DeadLetterExchange is where queues declared by DeclareAndBind send rejected
+// messages, and where undecodable messages are published.
+const DeadLetterExchange = "peril_dlx"
+
+// Headers added to poison messages before they are dead-lettered.
+const (
+	HeaderPoisonError         = "x-poison-error"
+	HeaderPoisonQueue         = "x-poison-queue"
+	HeaderOriginalExchange    = "x-original-exchange"
+	HeaderOriginalRoutingKey  = "x-original-routing-key"
+	HeaderOriginalContentType = "x-original-content-type"
+)
+
+// DecodeError is what a PoisonHandler receives when a body can't be decoded.
+type DecodeError struct {
+	Queue       string
+	ContentType string
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("pubsub: could not decode %q message from %s: %v", e.ContentType, e.Queue, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// PoisonHandler is told about every message that never reached the handler.
+type PoisonHandler func(msg RawDelivery, err *DecodeError)
+
+// poison takes an undecodable delivery out of circulation: it is republished
+// to the dead-letter exchange with headers describing the failure and then
+// acked. If that publish fails we fall back to a plain reject, which still
+// dead-letters the message through the queue's x-dead-letter-exchange.
+func (s *Subscription) poison(msg RawDelivery, err error, onPoison PoisonHandler) Acktype {
+	s.poisoned.Add(1)
+	decodeErr := &DecodeError{Queue: s.queue, ContentType: msg.ContentType, Err: err}
+
+	headers := copyTable(msg.Headers)
+	if headers == nil {
+		headers = Table{}
+	}
+	headers[HeaderPoisonError] = err.Error()
+	headers[HeaderPoisonQueue] = s.queue
+	headers[HeaderOriginalExchange] = msg.Exchange
+	headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	headers[HeaderOriginalContentType] = msg.ContentType
+
+	dead := msg.Message
+	dead.Headers = headers
+	acktype := Ack
+	if pubErr := s.channel.Publish(context.Background(), DeadLetterExchange, msg.RoutingKey, dead); pubErr != nil {
+		acktype = NackDiscard
+	}
+
+	if onPoison != nil {
+		onPoison(msg, decodeErr)
+	} else {
+		log.Print(decodeErr)
+	}
+	return acktype
+}
@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoisonDeadLettersUndecodableBody(t *testing.T) {
+	type move struct {
+		ToLocation string
+	}
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"broken JSON", "application/json", `{"ToLocation":`},
+		{"unknown content type", "text/csv", "alice,europe"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ch := memoryChannel(t)
+			for _, ex := range []struct {
+				name string
+				kind string
+			}{{"peril_topic", ExchangeTopic}, {DeadLetterExchange, ExchangeFanout}} {
+				if err := ch.ExchangeDeclare(ex.name, ex.kind, true, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := ch.QueueDeclare("dlq", true, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ch.QueueBind("dlq", "", DeadLetterExchange, nil); err != nil {
+				t.Fatal(err)
+			}
+			dead, err := ch.Consume("dlq", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			poisoned := make(chan *DecodeError, 1)
+			conn := b.Dial()
+			defer conn.Close()
+			sub, err := Subscribe(context.Background(), conn, "peril_topic", "moves", "army_moves.*", SimpleQueueTypeDurable,
+				func(move) Acktype {
+					t.Error("the handler got an undecodable message")
+					return Ack
+				},
+				OnPoison(func(msg RawDelivery, err *DecodeError) {
+					if string(msg.Body) != tt.body {
+						t.Errorf("OnPoison got body %q, want %q", msg.Body, tt.body)
+					}
+					poisoned <- err
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			msg := Message{ContentType: tt.contentType, Headers: Table{"x-game": "g1"}, Body: []byte(tt.body)}
+			if err := ch.Publish(context.Background(), "peril_topic", "army_moves.alice", msg); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-poisoned:
+				if err.Queue != "moves" || err.ContentType != tt.contentType || err.Err == nil {
+					t.Errorf("OnPoison got %+v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("OnPoison was never called")
+			}
+
+			d := receive(t, dead)
+			if string(d.Body) != tt.body || d.ContentType != tt.contentType {
+				t.Errorf("dead-lettered %q as %q, want the message as it was", d.Body, d.ContentType)
+			}
+			for header, want := range map[string]string{
+				"x-game":                  "g1",
+				HeaderPoisonQueue:         "moves",
+				HeaderOriginalExchange:    "peril_topic",
+				HeaderOriginalRoutingKey:  "army_moves.alice",
+				HeaderOriginalContentType: tt.contentType,
+			} {
+				if got, _ := d.Headers[header].(string); got != want {
+					t.Errorf("%s header is %q, want %q", header, got, want)
+				}
+			}
+			if reason, _ := d.Headers[HeaderPoisonError].(string); reason == "" {
+				t.Error("no poison error header")
+			}
+			if deaths := Deaths(d.Headers); len(deaths) != 0 {
+				t.Errorf("the message was rejected as well as republished: %+v", deaths)
+			}
+
+			// The poison message is acked, not left in the queue.
+			waitSettled(t, b, "moves")
+			if q, err := b.Queue("moves"); err != nil || q.Messages != 0 {
+				t.Errorf("queue left with %d messages (%v), want none", q.Messages, err)
+			}
+			if n := sub.Poisoned(); n != 1 {
+				t.Errorf("Poisoned() = %d, want 1", n)
+			}
+		})
+	}
+}
@@ -1,13 +1,8 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type SimpleQueueType string
@@ -23,197 +18,201 @@ const (
 	Ack Acktype = iota
 	NackRequeue
 	NackDiscard
+	// NackRetry puts the message back after a delay, see RetryPolicy.
+	NackRetry
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	b, err := json.Marshal(val)
+func (a Acktype) String() string {
+	switch a {
+	case Ack:
+		return "Ack"
+	case NackRequeue:
+		return "NackRequeue"
+	case NackDiscard:
+		return "NackDiscard"
+	case NackRetry:
+		return "NackRetry"
+	}
+	return fmt.Sprintf("Acktype(%d)", int(a))
+}
+
+// Publish encodes val with codec and publishes it, stamping the codec's
+// content type so subscribers know how to decode it, and the message's
+// Metadata. opts can link it to the message that caused it, see CausedBy.
+func Publish[T any](ch Publisher, codec Codec, exchange, key string, val T, opts ...PublishOption) error {
+	return publish(context.Background(), ch, codec, exchange, key, val, opts...)
+}
+
+func publish[T any](ctx context.Context, ch Publisher, codec Codec, exchange, key string, val T, opts ...PublishOption) error {
+	b, err := codec.Marshal(val)
 	if err != nil {
 		return err
 	}
 
-	pub := amqp.Publishing{
-		ContentType: "application/json",
+	pub := Message{
+		ContentType: codec.ContentType(),
 		Body:        b,
 	}
+	stamp(&pub, opts)
 
-	err = ch.PublishWithContext(context.Background(), exchange, key, false, false, pub)
+	return ch.Publish(ctx, exchange, key, pub)
+}
 
-	return err
+func PublishJSON[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, JSON, exchange, key, val, opts...)
 }
 
+// DeclareAndBind opens a channel, declares the queue and binds it to exchange.
+// opts refine the queue; they are validated before anything is declared.
 func DeclareAndBind(
-	conn *amqp.Connection,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
+	opts ...QueueOption,
+) (Channel, Queue, error) {
+	spec := NewQueueSpec(queueType, opts...)
+	if err := spec.Validate(); err != nil {
+		return nil, Queue{}, err
+	}
 
-	channel, err := conn.Channel()
+	channel, err := broker.Channel()
 	if err != nil {
-		return nil, amqp.Queue{}, err
+		return nil, Queue{}, err
 	}
 
 	// The durable parameter should only be true if queueType is durable.
 	// The autoDelete parameter should be true if queueType is transient.
 	// The exclusive parameter should be true if queueType is transient.
-	// It should pass in an amqp.Table to the QueueDeclare function that includes a x-dead-letter-exchange key.
-	// The value should be the name of your dead letter exchange ("peril_idx")
-	table := amqp.Table{
-		"x-dead-letter-exchange": "peril_dlx",
+	// The x-dead-letter-exchange argument is DeadLetterExchange unless opts say otherwise.
+	queue, err := channel.QueueDeclare(queueName, spec.Durable, spec.AutoDelete, spec.Exclusive, spec.Arguments())
+	if err != nil {
+		channel.Close()
+		return nil, Queue{}, err
 	}
 
-	queue, err := channel.QueueDeclare(queueName, queueType == SimpleQueueTypeDurable, queueType == SimpleQueueTypeTransient, queueType == SimpleQueueTypeTransient, false, table)
+	// The queue arguments belong to the declaration, not to the binding.
+	err = channel.QueueBind(queue.Name, key, exchange, nil)
 	if err != nil {
-		return nil, amqp.Queue{}, err
+		channel.Close()
+		return nil, Queue{}, err
 	}
 
-	err = channel.QueueBind(queueName, key, exchange, false, table)
-
-	return channel, queue, err
+	return channel, queue, nil
 
 }
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+// Subscribe declares and binds the queue and calls handler for every message.
+// The decoder is picked from each delivery's content type, so publishers are
+// free to use any registered codec. Messages that can't be decoded never reach
+// handler: they are dead-lettered with headers describing the error (see
+// OnPoison).
+func Subscribe[T any](
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
 	handler func(T) Acktype,
-) error {
-	channel, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeDelivery(ctx, broker, exchange, queueName, key, queueType, BodyHandler(handler), opts...)
+}
+
+// SubscribeDelivery is Subscribe for handlers that also want the message's
+// metadata, e.g. to publish follow-up messages with CausedBy. Wrap handler
+// with Chain to add middleware.
+func SubscribeDelivery[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	options := newSubscribeOptions(opts)
+	channel, queue, err := DeclareAndBind(broker, exchange, queueName, key, queueType, options.queue...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error
 	// CH7 L5 https://www.boot.dev/lessons/e1e10f9d-beda-4d0e-b948-a7ab800fb936
-	// Update your consumption code. It should call channel.Qos before calling channel.Consume. Limit the prefetch count to 10.
-	// err = channel.Qos(10, 1, true)
-
-	// 2. Get a new chan of amqp.Delivery structs by using the channel.Consume method.
-	// 2.1. Use an empty string for the consumer name so that it will be auto-generated
-	// 2.2 Set all other parameters to false/nil
-	// func (ch *Channel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args Table) (<-chan Delivery, error)
-	deliveries, err := channel.Consume(queue.Name, "", false, false, false, false, nil)
-	if err != nil {
-		return err
+	// The subscription calls channel.Qos before channel.Consume. The prefetch count defaults to 10.
+	sub := newSubscription(channel, queue.Name)
+	spec := NewQueueSpec(queueType, options.queue...)
+	sub.durable, sub.autoDelete, sub.exclusive = spec.Durable, spec.AutoDelete, spec.Exclusive
+	sub.prefetchCount = options.prefetchCount
+	sub.prefetchSize = options.prefetchSize
+	sub.workers = options.workers
+	sub.orderingKey = options.orderingKey
+	if options.retry != nil {
+		sub.retry = *options.retry
 	}
 
-	// 3. Start a goroutine that ranges over the channel of deliveries, and for each message:
-	go func() {
-		for msg := range deliveries {
-			// 3.1 Unmarshal the body (raw bytes) of each message delivery into the (generic) T type.
-			var t T
-			err := json.Unmarshal(msg.Body, &t)
-			if err != nil {
-				fmt.Println(err.Error())
-			}
-
-			ack := handler(t)
-
-			// Depending on the returned "acktype", the goroutine that calls the handler should either call...
-			switch ack {
-			case Ack:
-				msg.Ack(false)
-			case NackRequeue:
-				msg.Nack(false, true)
-			case NackDiscard:
-				msg.Nack(false, false)
-			}
-
+	// 2. Start consuming with our own consumer tag, so the subscription can cancel it.
+	// 3. The subscription's goroutines range over the channel of deliveries, and for each message:
+	err = sub.start(ctx, func(ctx context.Context, msg RawDelivery) Acktype {
+		// 3.1 Decode the body (raw bytes) of each message delivery into the (generic) T type.
+		// Sealed bodies are opened first.
+		var t T
+		opened, err := unseal(msg, options.sealKeys)
+		if err == nil {
+			err = decode(opened, &t)
+		}
+		if err != nil {
+			return sub.poison(msg, err, options.onPoison)
 		}
-	}()
 
-	return nil
+		return handler(newDelivery(ctx, msg, t))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
 }
 
-// Adaptat de PublishJSON
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(val)
-
+func decode(msg RawDelivery, v any) error {
+	codec, err := LookupCodec(msg.ContentType)
 	if err != nil {
 		return err
 	}
-
-	pub := amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        buf.Bytes(),
-	}
-
-	err = ch.PublishWithContext(context.Background(), exchange, key, false, false, pub)
-
-	return err
+	return codec.Unmarshal(msg.Body, v)
 }
 
-// Adaptat de SubscribeJSON
-func SubscribeGob[T any](
-	conn *amqp.Connection,
+// SubscribeJSON is kept for existing callers. Subscribe decodes JSON (and
+// every other registered codec) on its own.
+func SubscribeJSON[T any](
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
-	queueType SimpleQueueType, // an enum to represent "durable" or "transient"
+	queueType SimpleQueueType,
 	handler func(T) Acktype,
-) error {
-	channel, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return err
-	}
-
-	deliveries, err := channel.Consume(queue.Name, "", false, false, false, false, nil)
-	if err != nil {
-		return err
-	}
-
-	go func() {
-		for msg := range deliveries {
-			var t T
-			buf := bytes.NewBuffer(msg.Body)
-			dec := gob.NewDecoder(buf)
-			err := dec.Decode(&t)
-			if err != nil {
-				// TODO?
-			}
-			ack := handler(t)
-
-			// Depending on the returned "acktype", the goroutine that calls the handler should either call...
-			switch ack {
-			case Ack:
-				msg.Ack(false)
-			case NackRequeue:
-				msg.Nack(false, true)
-			case NackDiscard:
-				msg.Nack(false, false)
-			}
-
-		}
-	}()
-
-	return nil
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, queueType, handler, opts...)
 }
 
-/*
-func encode(gl GameLog) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(gl)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
+// Adaptat de PublishJSON
+func PublishGob[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, Gob, exchange, key, val, opts...)
 }
 
-func decode(data []byte) (GameLog, error) {
-	var gamelog GameLog
-	buf := bytes.NewBuffer(data)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&gamelog)
-
-	return gamelog, err
+// SubscribeGob is kept for existing callers, see SubscribeJSON.
+func SubscribeGob[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) Acktype,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, queueType, handler, opts...)
 }
-*/
@@ -0,0 +1,236 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+// Overflow behaviours for WithMaxLength.
+const (
+	OverflowDropHead         = "drop-head"
+	OverflowRejectPublish    = "reject-publish"
+	OverflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+// QueueSpec is everything DeclareQueue needs to know about a queue. It starts
+// from a SimpleQueueType and is refined with QueueOptions.
+type QueueSpec struct {
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+
+	Type                 string
+	DeadLetterExchange   string
+	MessageTTL           time.Duration
+	Expires              time.Duration
+	MaxLength            int
+	MaxLengthBytes       int
+	Overflow             string
+	MaxPriority          int
+	SingleActiveConsumer bool
+	Args                 Table
+}
+
+type QueueOption func(*QueueSpec)
+
+// NewQueueSpec applies opts on top of the defaults for queueType: durable
+// queues survive restarts, transient ones are exclusive and auto-deleted, and
+// both dead-letter to DeadLetterExchange.
+func NewQueueSpec(queueType SimpleQueueType, opts ...QueueOption) QueueSpec {
+	spec := QueueSpec{
+		Durable:            queueType == SimpleQueueTypeDurable,
+		AutoDelete:         queueType == SimpleQueueTypeTransient,
+		Exclusive:          queueType == SimpleQueueTypeTransient,
+		Type:               QueueTypeClassic,
+		DeadLetterExchange: DeadLetterExchange,
+	}
+	for _, opt := range opts {
+		opt(&spec)
+	}
+	return spec
+}
+
+// Quorum makes a replicated quorum queue. Only durable queues can be quorum.
+func Quorum() QueueOption {
+	return func(s *QueueSpec) {
+		s.Type = QueueTypeQuorum
+	}
+}
+
+// Stream makes an append-only stream. Streams don't dead-letter, so the
+// default dead-letter exchange is dropped.
+func Stream() QueueOption {
+	return func(s *QueueSpec) {
+		s.Type = QueueTypeStream
+		s.DeadLetterExchange = ""
+	}
+}
+
+// WithMessageTTL discards (dead-letters) messages that wait longer than ttl.
+func WithMessageTTL(ttl time.Duration) QueueOption {
+	return func(s *QueueSpec) {
+		s.MessageTTL = ttl
+	}
+}
+
+// WithExpires deletes the queue after it has gone unused for d, e.g. when
+// the client that owned it vanished.
+func WithExpires(d time.Duration) QueueOption {
+	return func(s *QueueSpec) {
+		s.Expires = d
+	}
+}
+
+// WithMaxLength caps the number of ready messages; overflow says what happens
+// to the extra ones.
+func WithMaxLength(n int, overflow string) QueueOption {
+	return func(s *QueueSpec) {
+		s.MaxLength = n
+		s.Overflow = overflow
+	}
+}
+
+func WithMaxLengthBytes(n int) QueueOption {
+	return func(s *QueueSpec) {
+		s.MaxLengthBytes = n
+	}
+}
+
+func WithMaxPriority(n int) QueueOption {
+	return func(s *QueueSpec) {
+		s.MaxPriority = n
+	}
+}
+
+func WithSingleActiveConsumer() QueueOption {
+	return func(s *QueueSpec) {
+		s.SingleActiveConsumer = true
+	}
+}
+
+// WithDeadLetterExchange overrides DeadLetterExchange. An empty name turns
+// dead-lettering off.
+func WithDeadLetterExchange(exchange string) QueueOption {
+	return func(s *QueueSpec) {
+		s.DeadLetterExchange = exchange
+	}
+}
+
+// WithArgument sets a raw x-argument that has no option of its own.
+func WithArgument(key string, value any) QueueOption {
+	return func(s *QueueSpec) {
+		if s.Args == nil {
+			s.Args = Table{}
+		}
+		s.Args[key] = value
+	}
+}
+
+// Validate catches combinations RabbitMQ would refuse, before we get as far
+// as a channel error.
+func (s QueueSpec) Validate() error {
+	var errs []error
+	switch s.Type {
+	case QueueTypeClassic:
+	case QueueTypeQuorum, QueueTypeStream:
+		if !s.Durable || s.AutoDelete || s.Exclusive {
+			errs = append(errs, fmt.Errorf("%s queues must be durable, not exclusive and not auto-delete", s.Type))
+		}
+		if s.MaxPriority > 0 {
+			errs = append(errs, fmt.Errorf("%s queues don't support priorities", s.Type))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown queue type %q", s.Type))
+	}
+	if s.Type == QueueTypeStream {
+		if s.DeadLetterExchange != "" {
+			errs = append(errs, errors.New("stream queues don't support dead-lettering"))
+		}
+		if s.MessageTTL > 0 || s.Expires > 0 || s.MaxLength > 0 || s.Overflow != "" {
+			errs = append(errs, errors.New("stream queues only support size-based retention"))
+		}
+	}
+
+	if s.MessageTTL < 0 {
+		errs = append(errs, errors.New("message TTL must not be negative"))
+	}
+	if s.Expires < 0 || (s.Expires > 0 && s.Expires < time.Millisecond) {
+		errs = append(errs, errors.New("queue expiry must be at least 1ms"))
+	}
+	if s.MaxLength < 0 || s.MaxLengthBytes < 0 {
+		errs = append(errs, errors.New("max length must not be negative"))
+	}
+	switch s.Overflow {
+	case "", OverflowDropHead, OverflowRejectPublish:
+	case OverflowRejectPublishDLX:
+		if s.Type == QueueTypeQuorum {
+			errs = append(errs, errors.New("quorum queues don't support reject-publish-dlx"))
+		}
+		if s.DeadLetterExchange == "" {
+			errs = append(errs, errors.New("reject-publish-dlx needs a dead-letter exchange"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown overflow behaviour %q", s.Overflow))
+	}
+	if s.MaxPriority < 0 || s.MaxPriority > 255 {
+		errs = append(errs, errors.New("max priority must be between 1 and 255"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("pubsub: invalid queue: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Arguments builds the x-arguments for QueueDeclare.
+func (s QueueSpec) Arguments() Table {
+	args := Table{}
+	for k, v := range s.Args {
+		args[k] = v
+	}
+	if s.Type != QueueTypeClassic {
+		args["x-queue-type"] = s.Type
+	}
+	if s.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = s.DeadLetterExchange
+	}
+	if s.MessageTTL > 0 {
+		args["x-message-ttl"] = s.MessageTTL.Milliseconds()
+	}
+	if s.Expires > 0 {
+		args["x-expires"] = s.Expires.Milliseconds()
+	}
+	if s.MaxLength > 0 {
+		args["x-max-length"] = int64(s.MaxLength)
+	}
+	if s.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = int64(s.MaxLengthBytes)
+	}
+	if s.Overflow != "" {
+		args["x-overflow"] = s.Overflow
+	}
+	if s.MaxPriority > 0 {
+		args["x-max-priority"] = int64(s.MaxPriority)
+	}
+	if s.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	return args
+}
+
+// DeclareQueue validates the spec built from queueType and opts and declares
+// the queue on ch.
+func DeclareQueue(ch Channel, name string, queueType SimpleQueueType, opts ...QueueOption) (Queue, error) {
+	spec := NewQueueSpec(queueType, opts...)
+	if err := spec.Validate(); err != nil {
+		return Queue{}, err
+	}
+	return ch.QueueDeclare(name, spec.Durable, spec.AutoDelete, spec.Exclusive, spec.Arguments())
+}
@@ -0,0 +1,65 @@
+package pubsub
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueSpecValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		queueType SimpleQueueType
+		opts      []QueueOption
+		want      string
+	}{
+		{"durable defaults", SimpleQueueTypeDurable, nil, ""},
+		{"transient defaults", SimpleQueueTypeTransient, nil, ""},
+		{"durable quorum", SimpleQueueTypeDurable, []QueueOption{Quorum(), WithMaxLength(100, OverflowRejectPublish)}, ""},
+		{"durable stream", SimpleQueueTypeDurable, []QueueOption{Stream(), WithMaxLengthBytes(1 << 20)}, ""},
+		{"classic with everything", SimpleQueueTypeDurable, []QueueOption{
+			WithMessageTTL(time.Second), WithExpires(time.Minute), WithMaxLength(10, OverflowRejectPublishDLX), WithMaxPriority(10), WithSingleActiveConsumer(),
+		}, ""},
+
+		{"unknown type", SimpleQueueTypeDurable, []QueueOption{func(s *QueueSpec) { s.Type = "lazy" }}, `unknown queue type "lazy"`},
+		{"transient quorum", SimpleQueueTypeTransient, []QueueOption{Quorum()}, "quorum queues must be durable"},
+		{"transient stream", SimpleQueueTypeTransient, []QueueOption{Stream()}, "stream queues must be durable"},
+		{"quorum with priorities", SimpleQueueTypeDurable, []QueueOption{Quorum(), WithMaxPriority(5)}, "quorum queues don't support priorities"},
+		{"stream with priorities", SimpleQueueTypeDurable, []QueueOption{Stream(), WithMaxPriority(5)}, "stream queues don't support priorities"},
+		{"dead-lettering stream", SimpleQueueTypeDurable, []QueueOption{Stream(), WithDeadLetterExchange(DeadLetterExchange)}, "don't support dead-lettering"},
+		{"stream with TTL", SimpleQueueTypeDurable, []QueueOption{Stream(), WithMessageTTL(time.Second)}, "only support size-based retention"},
+		{"stream with expiry", SimpleQueueTypeDurable, []QueueOption{Stream(), WithExpires(time.Minute)}, "only support size-based retention"},
+		{"stream with max length", SimpleQueueTypeDurable, []QueueOption{Stream(), WithMaxLength(10, "")}, "only support size-based retention"},
+		{"stream with overflow", SimpleQueueTypeDurable, []QueueOption{Stream(), WithMaxLength(0, OverflowDropHead)}, "only support size-based retention"},
+		{"negative TTL", SimpleQueueTypeDurable, []QueueOption{WithMessageTTL(-time.Second)}, "message TTL must not be negative"},
+		{"negative expiry", SimpleQueueTypeDurable, []QueueOption{WithExpires(-time.Second)}, "expiry must be at least 1ms"},
+		{"sub-millisecond expiry", SimpleQueueTypeDurable, []QueueOption{WithExpires(time.Microsecond)}, "expiry must be at least 1ms"},
+		{"negative max length", SimpleQueueTypeDurable, []QueueOption{WithMaxLength(-1, "")}, "max length must not be negative"},
+		{"negative max bytes", SimpleQueueTypeDurable, []QueueOption{WithMaxLengthBytes(-1)}, "max length must not be negative"},
+		{"quorum reject-publish-dlx", SimpleQueueTypeDurable, []QueueOption{Quorum(), WithMaxLength(10, OverflowRejectPublishDLX)}, "quorum queues don't support reject-publish-dlx"},
+		{"reject-publish-dlx without a DLX", SimpleQueueTypeDurable, []QueueOption{WithDeadLetterExchange(""), WithMaxLength(10, OverflowRejectPublishDLX)}, "needs a dead-letter exchange"},
+		{"unknown overflow", SimpleQueueTypeDurable, []QueueOption{WithMaxLength(10, "drop-tail")}, `unknown overflow behaviour "drop-tail"`},
+		{"negative priority", SimpleQueueTypeDurable, []QueueOption{WithMaxPriority(-1)}, "max priority must be between 1 and 255"},
+		{"priority too high", SimpleQueueTypeDurable, []QueueOption{WithMaxPriority(256)}, "max priority must be between 1 and 255"},
+	} {
+		err := NewQueueSpec(tt.queueType, tt.opts...).Validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: got %v, want an error mentioning %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestQueueSpecValidateReportsEverything(t *testing.T) {
+	err := NewQueueSpec(SimpleQueueTypeTransient, Quorum(), WithMaxPriority(5), WithMessageTTL(-time.Second)).Validate()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, want := range []string{"must be durable", "don't support priorities", "TTL must not be negative"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%v doesn't mention %q", err, want)
+		}
+	}
+}
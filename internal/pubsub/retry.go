@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// HeaderRetryCount counts how many times a message has been sent back
+// through a retry queue. The first time, the exchange and routing key it was
+// published to are kept in HeaderOriginalExchange and
+// HeaderOriginalRoutingKey, as it comes back through the default exchange.
+const HeaderRetryCount = "x-retry-count"
+
+// RetryPolicy says how long a NackRetry'd message waits before it is
+// delivered again, and how many times that may happen before the message is
+// dead-lettered for good.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     Backoff
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff: Backoff{
+		Initial: 1 * time.Second,
+		Max:     1 * time.Minute,
+	},
+}
+
+// retryLater parks msg in a retry queue for the policy's delay. Retry queues
+// have a message TTL and dead-letter through the default exchange straight
+// back into our queue, so other queues bound to the original exchange don't
+// see the message twice.
+func (s *Subscription) retryLater(msg RawDelivery) {
+	attempts := retryCount(msg.Headers) + 1
+	if attempts > s.retry.MaxAttempts {
+		s.deadLettered.Add(1)
+		msg.Nack(false)
+		return
+	}
+
+	delay := s.retry.Backoff.delay(attempts - 1)
+	retryQueue, err := s.retryQueue(delay)
+	if err != nil {
+		log.Printf("pubsub: could not declare retry queue: %s", err)
+		msg.Nack(true)
+		return
+	}
+
+	headers := copyTable(msg.Headers)
+	if headers == nil {
+		headers = Table{}
+	}
+	headers[HeaderRetryCount] = int64(attempts)
+	if _, ok := headers[HeaderOriginalExchange]; !ok {
+		headers[HeaderOriginalExchange] = msg.Exchange
+		headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	}
+	retry := msg.Message
+	retry.Headers = headers
+	if err := s.channel.Publish(context.Background(), "", retryQueue, retry); err != nil {
+		log.Printf("pubsub: could not schedule retry: %s", err)
+		msg.Nack(true)
+		return
+	}
+	s.retried.Add(1)
+	msg.Ack()
+}
+
+// retryQueueExpiry is how long the retry queue of an auto-delete queue is
+// kept once its last message has gone back.
+const retryQueueExpiry = time.Minute
+
+// retryQueue declares the queue that holds messages for delay.
+func (s *Subscription) retryQueue(delay time.Duration) (string, error) {
+	name := fmt.Sprintf("%s.retry.%dms", s.queue, delay.Milliseconds())
+	s.retryMu.Lock()
+	defer s.retryMu.Unlock()
+	if s.retryQueues[name] && !s.autoDelete {
+		return name, nil
+	}
+
+	args := Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": s.queue,
+	}
+	// Retry queues live as long as the queue they feed. They belong to the
+	// same connection as an exclusive queue, so they go with it. Nobody
+	// consumes from them, so auto-delete would never kick in; instead they
+	// expire once unused, and are redeclared on every retry to put that off.
+	if s.autoDelete {
+		args["x-expires"] = (delay + retryQueueExpiry).Milliseconds()
+	}
+	_, err := s.channel.QueueDeclare(name, s.durable, false, s.exclusive, args)
+	if err != nil {
+		return "", err
+	}
+	s.retryQueues[name] = true
+	return name, nil
+}
+
+func retryCount(headers Table) int {
+	n, _ := tableInt(headers, HeaderRetryCount)
+	return int(n)
+}
+
+// tableInt reads a number from a Table whatever integer type the transport
+// decoded it into. STOMP headers are text, so numeric strings count too.
+func tableInt(t Table, key string) (int64, bool) {
+	switch v := t[key].(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// Retried counts messages sent to a retry queue.
+func (s *Subscription) Retried() uint64 {
+	return s.retried.Load()
+}
+
+// DeadLettered counts messages rejected for good after MaxAttempts retries.
+func (s *Subscription) DeadLettered() uint64 {
+	return s.deadLettered.Load()
+}
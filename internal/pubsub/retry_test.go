@@ -0,0 +1,150 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryQueueGoesWithTransientQueue(t *testing.T) {
+	b := NewMemoryBroker()
+	conn := b.Dial()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("peril_direct", ExchangeDirect, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan struct{}, 2)
+	first := true
+	sub, err := Subscribe(context.Background(), conn, "peril_direct", "pause.g1.alice", "pause.g1", SimpleQueueTypeTransient, func(string) Acktype {
+		handled <- struct{}{}
+		if first {
+			first = false
+			return NackRetry
+		}
+		return Ack
+	}, WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(ch, "peril_direct", "pause.g1", "pause"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatalf("message handled %d times, want 2", i)
+		}
+	}
+
+	const retryQueue = "pause.g1.alice.retry.10ms"
+	b.mu.Lock()
+	q, ok := b.queues[retryQueue]
+	if !ok {
+		b.mu.Unlock()
+		t.Fatalf("retry queue %s was not declared", retryQueue)
+	}
+	exclusive, autoDelete, durable := q.exclusive, q.autoDelete, q.durable
+	_, expires := tableInt(q.args, "x-expires")
+	b.mu.Unlock()
+	if !exclusive || durable || autoDelete || !expires {
+		t.Errorf("retry queue exclusive=%v durable=%v autoDelete=%v x-expires=%v, want an exclusive transient queue that expires", exclusive, durable, autoDelete, expires)
+	}
+
+	conn.Close()
+	if _, err := b.Queue(retryQueue); !errors.Is(err, ErrQueueNotFound) {
+		t.Errorf("retry queue outlived its connection: %v", err)
+	}
+}
+
+func TestRetryQueueOfDurableQueueIsDurable(t *testing.T) {
+	b := NewMemoryBroker()
+	conn := b.Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newSubscription(ch, "game_logs")
+	sub.durable = true
+	name, err := sub.retryQueue(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queues[name]
+	if _, expires := tableInt(q.args, "x-expires"); !q.durable || q.exclusive || expires {
+		t.Errorf("retry queue of a durable queue: durable=%v exclusive=%v x-expires=%v", q.durable, q.exclusive, expires)
+	}
+}
+
+func TestRetriesDoNotGrowManagedChannelOps(t *testing.T) {
+	b := NewMemoryBroker()
+	managed, err := NewManagedBroker(func() (Broker, error) { return b.Dial(), nil }, Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer managed.Close()
+	ch, err := managed.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("peril_direct", ExchangeDirect, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every message is retried once, redeclaring the auto-delete queue's
+	// retry queue each time.
+	handled := make(chan struct{}, 100)
+	sub, err := SubscribeDelivery(context.Background(), managed, "peril_direct", "pause.g1.alice", "pause.g1", SimpleQueueTypeTransient, func(d Delivery[string]) Acktype {
+		handled <- struct{}{}
+		if retryCount(d.raw.Headers) == 0 {
+			return NackRetry
+		}
+		return Ack
+	}, WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Initial: time.Millisecond, Max: time.Millisecond}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	mc := sub.channel.(*managedChannel)
+	ops := func() int {
+		mc.mu.Lock()
+		defer mc.mu.Unlock()
+		return len(mc.ops)
+	}
+
+	publish := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := PublishJSON(ch, "peril_direct", "pause.g1", "pause"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 2*n; i++ {
+			select {
+			case <-handled:
+			case <-time.After(time.Second):
+				t.Fatalf("%d of %d deliveries handled", i, 2*n)
+			}
+		}
+	}
+	publish(1)
+	want := ops()
+	publish(50)
+	if sub.Retried() != 51 {
+		t.Fatalf("%d retries, want 51", sub.Retried())
+	}
+	if got := ops(); got != want {
+		t.Errorf("%d recorded ops after 51 retries, %d after the first", got, want)
+	}
+}
@@ -0,0 +1,225 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReplyToQueue is RabbitMQ's direct reply-to pseudo-queue. Replies published
+// to it skip real queues and go straight to the channel that made the call.
+const ReplyToQueue = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError carries the error returned by a Serve handler.
+const HeaderRPCError = "x-rpc-error"
+
+// DefaultCallTimeout bounds a Call whose context has no deadline.
+const DefaultCallTimeout = 5 * time.Second
+
+// RemoteError is an error returned by the handler on the other side of a Call.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: remote call failed: " + e.Message
+}
+
+// RPCClient makes Calls. It owns a channel consuming ReplyToQueue and hands
+// each reply to the call with the same correlation ID.
+type RPCClient struct {
+	ch        Channel
+	publisher *ConfirmingPublisher
+	tag       string
+	// Codec encodes requests. Servers answer in the same format.
+	Codec Codec
+	// Signer signs requests when set, see SignAll. Set it before making
+	// calls.
+	Signer *Signer
+
+	mu      sync.Mutex
+	pending map[string]chan RawDelivery
+	closed  bool
+}
+
+func NewRPCClient(broker Broker) (*RPCClient, error) {
+	ch, err := broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// Requests are confirmed and mandatory, so a call to a server that
+	// isn't there fails right away instead of timing out.
+	publisher, err := NewConfirmingPublisher(ch)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	c := &RPCClient{
+		ch:        ch,
+		publisher: publisher,
+		tag:       newConsumerTag(),
+		Codec:     JSON,
+		pending:   map[string]chan RawDelivery{},
+	}
+	replies, err := ch.Consume(ReplyToQueue, c.tag)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	go c.dispatch(replies)
+	return c, nil
+}
+
+func (c *RPCClient) dispatch(replies <-chan RawDelivery) {
+	for msg := range replies {
+		c.mu.Lock()
+		reply, ok := c.pending[msg.CorrelationID]
+		delete(c.pending, msg.CorrelationID)
+		c.mu.Unlock()
+		// Late replies to calls that already gave up are dropped.
+		if ok {
+			reply <- msg
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+}
+
+func (c *RPCClient) register(id string) (chan RawDelivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	reply := make(chan RawDelivery, 1)
+	c.pending[id] = reply
+	return reply, nil
+}
+
+func (c *RPCClient) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *RPCClient) Close() error {
+	c.ch.Cancel(c.tag)
+	return c.ch.Close()
+}
+
+// Call publishes req to exchange with key and waits for the reply. It gives up
+// when ctx is done, or after DefaultCallTimeout if ctx has no deadline. opts
+// adjust the request, e.g. CausedBy.
+func Call[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
+	// The request starts its own correlation, so its message ID is what the
+	// reply's correlation ID will be.
+	id := NewMessageID()
+	reply, err := c.register(id)
+	if err != nil {
+		return resp, err
+	}
+	defer c.forget(id)
+
+	opts = append([]PublishOption{WithMessageID(id), WithReplyTo(ReplyToQueue)}, opts...)
+	var publisher Publisher = c.publisher
+	if c.Signer != nil {
+		publisher = SignAll(publisher, *c.Signer)
+	}
+	err = publish(ctx, publisher, c.Codec, exchange, key, req, opts...)
+	var unroutable *UnroutableError
+	if errors.As(err, &unroutable) {
+		return resp, fmt.Errorf("pubsub: nobody is serving %s: %w", key, err)
+	}
+	if err != nil {
+		return resp, err
+	}
+
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return resp, fmt.Errorf("pubsub: waiting for reply: %w", ErrClosed)
+		}
+		if text, ok := msg.Headers[HeaderRPCError].(string); ok {
+			return resp, &RemoteError{Message: text}
+		}
+		if err := decode(msg, &resp); err != nil {
+			return resp, fmt.Errorf("pubsub: could not decode reply: %w", err)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return resp, fmt.Errorf("pubsub: waiting for reply: %w", ctx.Err())
+	}
+}
+
+// Serve answers Calls sent to exchange with key. Requests are consumed from
+// queueName like any subscription; every server instance sharing the queue
+// takes a share of the calls. Errors returned by handler reach the caller as
+// a RemoteError. middleware runs before handler, and can turn a request down
+// without an answer, e.g. Verify.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(context.Context, Req) (Resp, error),
+	middleware []Middleware[Req],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	replies, err := broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := SubscribeDelivery(ctx, broker, exchange, queueName, key, queueType, Chain(func(d Delivery[Req]) Acktype {
+		// d's context carries the deadline middleware such as Timeout set.
+		resp, err := handler(d.Context(), d.Body)
+		if d.ReplyTo == "" {
+			if err != nil {
+				log.Printf("pubsub: rpc %s failed with nobody to tell: %s", key, err)
+			}
+			return Ack
+		}
+
+		codec, lookupErr := LookupCodec(d.ContentType)
+		if lookupErr != nil {
+			codec = JSON
+		}
+		replyOpts := []PublishOption{CausedBy(d.Metadata)}
+		if err != nil {
+			replyOpts = append(replyOpts, WithHeader(HeaderRPCError, err.Error()))
+		}
+		// Running the handler again wouldn't help if the caller is gone,
+		// so a reply that can't be sent is only logged.
+		if err := Publish(replies, codec, "", d.ReplyTo, resp, replyOpts...); err != nil {
+			log.Printf("pubsub: could not reply to rpc %s: %s", key, err)
+		}
+		return Ack
+	}, middleware...), opts...)
+	if err != nil {
+		replies.Close()
+		return nil, err
+	}
+	go func() {
+		<-sub.Done()
+		replies.Close()
+	}()
+	return sub, nil
+}
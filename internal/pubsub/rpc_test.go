@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rpcBroker is a MemoryBroker with the game's direct exchange and an
+// RPCClient on it.
+func rpcBroker(t *testing.T) (*MemoryConnection, *RPCClient) {
+	t.Helper()
+	conn := NewMemoryBroker().Dial()
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err := ch.ExchangeDeclare("peril_direct", ExchangeDirect, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRPCClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return conn, client
+}
+
+func serveTest[Req, Resp any](t *testing.T, conn *MemoryConnection, key string, handler func(context.Context, Req) (Resp, error), middleware ...Middleware[Req]) {
+	t.Helper()
+	sub, err := Serve(context.Background(), conn, "peril_direct", key, key, SimpleQueueTypeTransient, handler, middleware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+}
+
+func TestCallServeRoundTrip(t *testing.T) {
+	conn, client := rpcBroker(t)
+	serveTest(t, conn, "spawn", func(_ context.Context, location string) (string, error) {
+		return "infantry in " + location, nil
+	})
+
+	got, err := Call[string, string](context.Background(), client, "peril_direct", "spawn", "europe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "infantry in europe" {
+		t.Errorf("got %q, want infantry in europe", got)
+	}
+}
+
+func TestServeHandlerGetsDeliveryDeadline(t *testing.T) {
+	conn, client := rpcBroker(t)
+	serveTest(t, conn, "move", func(ctx context.Context, _ string) (time.Duration, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return 0, errors.New("no deadline")
+		}
+		return time.Until(deadline), nil
+	}, Timeout[string](time.Minute))
+
+	left, err := Call[string, time.Duration](context.Background(), client, "peril_direct", "move", "asia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left <= 0 || left > time.Minute {
+		t.Errorf("handler had %s left, want Timeout's minute", left)
+	}
+}
+
+func TestCallTimesOut(t *testing.T) {
+	conn, client := rpcBroker(t)
+	release := make(chan struct{})
+	defer close(release)
+	serveTest(t, conn, "slow", func(ctx context.Context, _ string) (string, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return "too late", nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Call[string, string](ctx, client, "peril_direct", "slow", "hello")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the caller's deadline", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("gave up after %s", took)
+	}
+}
+
+func TestCallRemoteError(t *testing.T) {
+	conn, client := rpcBroker(t)
+	serveTest(t, conn, "move", func(context.Context, string) (string, error) {
+		return "", errors.New("asia is not next to europe")
+	})
+
+	_, err := Call[string, string](context.Background(), client, "peril_direct", "move", "asia")
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != "asia is not next to europe" {
+		t.Fatalf("got %v, want the handler's error as a RemoteError", err)
+	}
+}
+
+func TestCallNobodyServing(t *testing.T) {
+	_, client := rpcBroker(t)
+	_, err := Call[string, string](context.Background(), client, "peril_direct", "nobody", "hello")
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) || !strings.Contains(err.Error(), "nobody is serving nobody") {
+		t.Fatalf("got %v, want an UnroutableError", err)
+	}
+}
@@ -0,0 +1,182 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"mime"
+	"sync"
+)
+
+// ContentTypeSealed marks a body encrypted for one recipient. The content
+// type's parameters name the recipient and the inner content type the
+// plaintext is encoded with:
+//
+//	application/vnd.peril.sealed; inner=application/json; recipient=g1/alice
+const ContentTypeSealed = "application/vnd.peril.sealed"
+
+// SealKeySize is the size of the AES-256 keys Sealed uses.
+const SealKeySize = 32
+
+var ErrNoSealKey = errors.New("pubsub: no key to open sealed message")
+
+// NewSealKey returns a random key for Sealed.
+func NewSealKey() []byte {
+	key := make([]byte, SealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Sealed wraps inner so what it marshals can only be read with recipient's
+// key. Bodies are encrypted with AES-GCM under a fresh nonce; the recipient
+// and the inner content type are authenticated too, so a sealed body can't
+// be passed off as meant for somebody else. Subscribers open sealed messages
+// with OpenWith.
+func Sealed(inner Codec, recipient string, key []byte) (Codec, error) {
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedCodec{inner: inner, recipient: recipient, aead: aead}, nil
+}
+
+func newSealAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != SealKeySize {
+		return nil, fmt.Errorf("pubsub: seal keys are %d bytes, not %d", SealKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type sealedCodec struct {
+	inner     Codec
+	recipient string
+	aead      cipher.AEAD
+}
+
+func (c *sealedCodec) ContentType() string {
+	return mime.FormatMediaType(ContentTypeSealed, map[string]string{
+		"inner":     c.inner.ContentType(),
+		"recipient": c.recipient,
+	})
+}
+
+func (c *sealedCodec) Marshal(v any) ([]byte, error) {
+	plaintext, err := c.inner.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, sealedData(c.recipient, c.inner.ContentType())), nil
+}
+
+func (c *sealedCodec) Unmarshal(data []byte, v any) error {
+	plaintext, err := openSealed(c.aead, c.recipient, c.inner.ContentType(), data)
+	if err != nil {
+		return err
+	}
+	return c.inner.Unmarshal(plaintext, v)
+}
+
+func sealedData(recipient, inner string) []byte {
+	return []byte(recipient + "\x00" + inner)
+}
+
+func openSealed(aead cipher.AEAD, recipient, inner string, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("pubsub: sealed message too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, sealedData(recipient, inner))
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: could not open message sealed for %s: %w", recipient, err)
+	}
+	return plaintext, nil
+}
+
+// SealKeys holds the keys sealed messages are opened with, by recipient.
+type SealKeys struct {
+	mu   sync.RWMutex
+	keys map[string]cipher.AEAD
+}
+
+func NewSealKeys() *SealKeys {
+	return &SealKeys{keys: map[string]cipher.AEAD{}}
+}
+
+// Add sets recipient's key, replacing any it had.
+func (k *SealKeys) Add(recipient string, key []byte) error {
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[recipient] = aead
+	return nil
+}
+
+func (k *SealKeys) Remove(recipient string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, recipient)
+}
+
+// Sealed is Sealed with recipient's key from k.
+func (k *SealKeys) Sealed(inner Codec, recipient string) (Codec, error) {
+	aead, ok := k.lookup(recipient)
+	if !ok {
+		return nil, fmt.Errorf("%w for %s", ErrNoSealKey, recipient)
+	}
+	return &sealedCodec{inner: inner, recipient: recipient, aead: aead}, nil
+}
+
+func (k *SealKeys) lookup(recipient string) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[recipient]
+	return aead, ok
+}
+
+// OpenWith lets a subscription decode messages sealed for any recipient in
+// keys. Sealed messages it has no key for are dead-lettered like any other
+// message that can't be decoded.
+func OpenWith(keys *SealKeys) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.sealKeys = keys
+	}
+}
+
+// unseal returns msg's plaintext and its content type if it is sealed, and
+// msg unchanged otherwise.
+func unseal(msg RawDelivery, keys *SealKeys) (RawDelivery, error) {
+	mediaType, params, err := mime.ParseMediaType(msg.ContentType)
+	if err != nil || mediaType != ContentTypeSealed {
+		return msg, nil
+	}
+	recipient, inner := params["recipient"], params["inner"]
+	if keys == nil {
+		return msg, fmt.Errorf("%w for %s", ErrNoSealKey, recipient)
+	}
+	aead, ok := keys.lookup(recipient)
+	if !ok {
+		return msg, fmt.Errorf("%w for %s", ErrNoSealKey, recipient)
+	}
+	plaintext, err := openSealed(aead, recipient, inner, msg.Body)
+	if err != nil {
+		return msg, err
+	}
+	msg.ContentType = inner
+	msg.Body = plaintext
+	return msg, nil
+}
@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type sealedWar struct {
+	Winner string
+}
+
+// sealedSubscriber subscribes alice to war results with her seal key and
+// returns what reaches the handler and what is poisoned.
+func sealedSubscriber(t *testing.T, aliceKey []byte) (Channel, <-chan sealedWar, <-chan error) {
+	t.Helper()
+	conn := NewMemoryBroker().Dial()
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("peril_topic", ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	keys := NewSealKeys()
+	if err := keys.Add("g1/alice", aliceKey); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan sealedWar, 1)
+	poisoned := make(chan error, 1)
+	sub, err := Subscribe(context.Background(), conn, "peril_topic", "war.g1.alice", "war.g1.alice", SimpleQueueTypeTransient,
+		func(war sealedWar) Acktype {
+			handled <- war
+			return Ack
+		},
+		OpenWith(keys),
+		OnPoison(func(_ RawDelivery, err *DecodeError) { poisoned <- err }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return ch, handled, poisoned
+}
+
+func sealedMessage(t *testing.T, recipient string, key []byte) Message {
+	t.Helper()
+	codec, err := Sealed(JSON, recipient, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := codec.Marshal(sealedWar{Winner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Message{ContentType: codec.ContentType(), Body: body}
+}
+
+func TestSealedRoundTrip(t *testing.T) {
+	key := NewSealKey()
+	ch, handled, poisoned := sealedSubscriber(t, key)
+	if err := ch.Publish(context.Background(), "peril_topic", "war.g1.alice", sealedMessage(t, "g1/alice", key)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case war := <-handled:
+		if war.Winner != "alice" {
+			t.Errorf("opened %+v, want alice as the winner", war)
+		}
+	case err := <-poisoned:
+		t.Fatalf("could not open a message sealed for alice: %s", err)
+	case <-time.After(time.Second):
+		t.Fatal("sealed message never arrived")
+	}
+}
+
+func TestSealedMessagesAliceCannotOpen(t *testing.T) {
+	key := NewSealKey()
+	flip := func(i int) func(Message) Message {
+		return func(msg Message) Message {
+			body := append([]byte(nil), msg.Body...)
+			body[i] ^= 1
+			msg.Body = body
+			return msg
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		msg    func(*testing.T) Message
+		noSeal bool
+	}{
+		{name: "wrong key", msg: func(t *testing.T) Message { return sealedMessage(t, "g1/alice", NewSealKey()) }},
+		{name: "tampered nonce", msg: func(t *testing.T) Message { return flip(0)(sealedMessage(t, "g1/alice", key)) }},
+		{name: "tampered ciphertext", msg: func(t *testing.T) Message {
+			msg := sealedMessage(t, "g1/alice", key)
+			return flip(len(msg.Body) - 1)(msg)
+		}},
+		{name: "truncated", msg: func(t *testing.T) Message {
+			msg := sealedMessage(t, "g1/alice", key)
+			msg.Body = msg.Body[:4]
+			return msg
+		}},
+		{name: "relabelled for alice", msg: func(t *testing.T) Message {
+			// Sealed with alice's key, but for bob: the recipient is
+			// authenticated, so changing the label doesn't help.
+			msg := sealedMessage(t, "g1/bob", key)
+			msg.ContentType = (&sealedCodec{inner: JSON, recipient: "g1/alice"}).ContentType()
+			return msg
+		}},
+		{name: "sealed for bob", msg: func(t *testing.T) Message { return sealedMessage(t, "g1/bob", NewSealKey()) }, noSeal: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, handled, poisoned := sealedSubscriber(t, key)
+			if err := ch.Publish(context.Background(), "peril_topic", "war.g1.alice", tt.msg(t)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case war := <-handled:
+				t.Fatalf("alice opened %+v", war)
+			case err := <-poisoned:
+				if tt.noSeal != errors.Is(err, ErrNoSealKey) {
+					t.Errorf("poisoned with %s, want ErrNoSealKey: %v", err, tt.noSeal)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("message was neither handled nor poisoned")
+			}
+		})
+	}
+}
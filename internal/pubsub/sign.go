@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A signed message carries who signed it, when, and an Ed25519 signature
+// over those, the content type, the exchange and routing key it was
+// published to, its message ID and its body. So a signed message can't be
+// republished under another key, and replaying it later gets it rejected as
+// stale, or caught by Deduplicate by its ID.
+const (
+	HeaderSigner    = "x-signer"
+	HeaderSignedAt  = "x-signed-at"
+	HeaderSignature = "x-signature"
+)
+
+// SignatureMaxAge is how old, or how far in the future, a signature may be
+// when it is verified. Messages that wait longer in a queue, e.g. for a
+// server that's down, are rejected too.
+var SignatureMaxAge = 10 * time.Minute
+
+var ErrBadSignature = errors.New("pubsub: missing or invalid signature")
+
+// Signer signs messages on behalf of an identity, e.g. a player.
+type Signer struct {
+	Identity string
+	Key      ed25519.PrivateKey
+}
+
+// sign signs msg as s for publishing to exchange with key, now.
+func (s Signer) sign(exchange, key string, msg *Message, now time.Time) {
+	signedAt := now.Unix()
+	sig := ed25519.Sign(s.Key, signedBytes(s.Identity, signedAt, exchange, key, *msg))
+	msg.Headers[HeaderSigner] = s.Identity
+	msg.Headers[HeaderSignedAt] = signedAt
+	msg.Headers[HeaderSignature] = base64.StdEncoding.EncodeToString(sig)
+}
+
+func signedBytes(identity string, signedAt int64, exchange, key string, msg Message) []byte {
+	var b []byte
+	for _, field := range []string{identity, strconv.FormatInt(signedAt, 10), msg.ContentType, exchange, key, msg.MessageID} {
+		b = append(b, field...)
+		b = append(b, 0)
+	}
+	return append(b, msg.Body...)
+}
+
+// SignAll wraps p so every message published through it is signed as s.
+func SignAll(p Publisher, s Signer) Publisher {
+	return &signingPublisher{Publisher: p, signer: s}
+}
+
+type signingPublisher struct {
+	Publisher
+	signer Signer
+}
+
+func (p *signingPublisher) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	// The caller may hold on to the headers, e.g. in an outbox.
+	headers := Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	msg.Headers = headers
+	p.signer.sign(exchange, key, &msg, time.Now())
+	return p.Publisher.Publish(ctx, exchange, key, msg)
+}
+
+// Keyring holds the public keys messages are verified with, by identity.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[string]ed25519.PublicKey
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string]ed25519.PublicKey{}}
+}
+
+// Add sets identity's key, replacing any it had.
+func (k *Keyring) Add(identity string, key ed25519.PublicKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[identity] = key
+}
+
+func (k *Keyring) Remove(identity string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, identity)
+}
+
+func (k *Keyring) Lookup(identity string) (ed25519.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[identity]
+	return key, ok
+}
+
+// VerifySignature checks that msg, published to exchange with key, was
+// signed by identity with identity's key in keys, no more than
+// SignatureMaxAge from now.
+func VerifySignature(keys *Keyring, identity, exchange, key string, msg Message, now time.Time) error {
+	signer, _ := msg.Headers[HeaderSigner].(string)
+	if signer != identity {
+		return fmt.Errorf("%w: signed by %q, not %q", ErrBadSignature, signer, identity)
+	}
+	public, ok := keys.Lookup(identity)
+	if !ok {
+		return fmt.Errorf("%w: no key for %q", ErrBadSignature, identity)
+	}
+	signedAt, ok := tableInt(msg.Headers, HeaderSignedAt)
+	if !ok {
+		return fmt.Errorf("%w: no signing time", ErrBadSignature)
+	}
+	encoded, _ := msg.Headers[HeaderSignature].(string)
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || !ed25519.Verify(public, signedBytes(signer, signedAt, exchange, key, msg), sig) {
+		return ErrBadSignature
+	}
+	if age := now.Sub(time.Unix(signedAt, 0)); age > SignatureMaxAge || age < -SignatureMaxAge {
+		return fmt.Errorf("%w: signed %s ago", ErrBadSignature, age.Round(time.Second))
+	}
+	return nil
+}
+
+// Verify only lets through messages signed by whoever claimed says sent them,
+// usually someone named in the body. Anything else is dead-lettered.
+func Verify[T any](keys *Keyring, claimed func(T) string) Middleware[T] {
+	return VerifyAny(keys, func(body T) []string { return []string{claimed(body)} })
+}
+
+// VerifyAny is Verify for messages more than one identity may send, e.g. a
+// player or the server on the player's behalf.
+func VerifyAny[T any](keys *Keyring, claimed func(T) []string) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) Acktype {
+			exchange, key := publishedTo(d)
+			if err := verifyAny(keys, claimed(d.Body), exchange, key, d.raw); err != nil {
+				log.Printf("pubsub: rejecting message %s: %s", d.MessageID, err)
+				return NackDiscard
+			}
+			return next(d)
+		}
+	}
+}
+
+func verifyAny(keys *Keyring, identities []string, exchange, key string, msg Message) error {
+	signer, _ := msg.Headers[HeaderSigner].(string)
+	for _, identity := range identities {
+		if signer == identity {
+			return VerifySignature(keys, identity, exchange, key, msg, time.Now())
+		}
+	}
+	return fmt.Errorf("%w: signed by %q, not any of %q", ErrBadSignature, signer, identities)
+}
+
+// publishedTo is where d was signed for. A message back from a retry queue
+// comes through the default exchange, with where it was first published in
+// headers retryLater added.
+func publishedTo[T any](d Delivery[T]) (exchange, key string) {
+	if d.Exchange == "" {
+		exchange, ok1 := d.raw.Headers[HeaderOriginalExchange].(string)
+		key, ok2 := d.raw.Headers[HeaderOriginalRoutingKey].(string)
+		if ok1 && ok2 {
+			return exchange, key
+		}
+	}
+	return d.Exchange, d.RoutingKey
+}
@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T, keys *Keyring, identity string) Signer {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.Add(identity, public)
+	return Signer{Identity: identity, Key: private}
+}
+
+func TestSignatureCoversRouteIDAndTime(t *testing.T) {
+	keys := NewKeyring()
+	alice := newTestSigner(t, keys, "g1/alice")
+	now := time.Now()
+	signed := func() Message {
+		msg := Message{ContentType: "application/json", MessageID: "m1", Headers: Table{}, Body: []byte(`{"ToLocation":"asia"}`)}
+		alice.sign("peril_direct", "move", &msg, now)
+		return msg
+	}
+	if err := VerifySignature(keys, "g1/alice", "peril_direct", "move", signed(), now); err != nil {
+		t.Fatalf("alice's own move: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		exchange string
+		key      string
+		change   func(*Message)
+		at       time.Time
+	}{
+		{name: "another key", exchange: "peril_direct", key: "spawn"},
+		{name: "another exchange", exchange: "peril_topic", key: "move"},
+		{name: "another message ID", exchange: "peril_direct", key: "move", change: func(msg *Message) { msg.MessageID = "m2" }},
+		{name: "another body", exchange: "peril_direct", key: "move", change: func(msg *Message) { msg.Body = []byte(`{"ToLocation":"europe"}`) }},
+		{name: "re-timed", exchange: "peril_direct", key: "move", change: func(msg *Message) { msg.Headers[HeaderSignedAt] = now.Add(time.Hour).Unix() }},
+		{name: "no signing time", exchange: "peril_direct", key: "move", change: func(msg *Message) { delete(msg.Headers, HeaderSignedAt) }},
+		{name: "replayed later", exchange: "peril_direct", key: "move", at: now.Add(SignatureMaxAge + time.Minute)},
+		{name: "from the future", exchange: "peril_direct", key: "move", at: now.Add(-SignatureMaxAge - time.Minute)},
+	} {
+		msg := signed()
+		if tt.change != nil {
+			tt.change(&msg)
+		}
+		at := now
+		if !tt.at.IsZero() {
+			at = tt.at
+		}
+		if err := VerifySignature(keys, "g1/alice", tt.exchange, tt.key, msg, at); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%s: got %v, want ErrBadSignature", tt.name, err)
+		}
+	}
+}
+
+func TestVerifyAcceptsRetriedMessage(t *testing.T) {
+	conn := NewMemoryBroker().Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("peril_topic", ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeyring()
+	alice := newTestSigner(t, keys, "g1/alice")
+
+	// The first delivery is retried, so the second comes back through the
+	// default exchange and still has to verify.
+	handled := make(chan int, 2)
+	sub, err := SubscribeDelivery(context.Background(), conn, "peril_topic", "game_logs", "game_logs.*.*", SimpleQueueTypeTransient,
+		Chain(func(d Delivery[string]) Acktype {
+			handled <- retryCount(d.raw.Headers)
+			if retryCount(d.raw.Headers) == 0 {
+				return NackRetry
+			}
+			return Ack
+		}, Verify(keys, func(string) string { return "g1/alice" })),
+		WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(SignAll(ch, alice), "peril_topic", "game_logs.g1.alice", "alice won"); err != nil {
+		t.Fatal(err)
+	}
+	for want := 0; want < 2; want++ {
+		select {
+		case retries := <-handled:
+			if retries != want {
+				t.Errorf("handled after %d retries, want %d", retries, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d never got past Verify", want+1)
+		}
+	}
+}
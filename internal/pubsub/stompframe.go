@@ -0,0 +1,308 @@
+package pubsub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stompFrame is one STOMP 1.2 frame.
+type stompFrame struct {
+	command string
+	header  map[string]string
+	body    []byte
+}
+
+func newSTOMPFrame(command string, kv ...string) *stompFrame {
+	f := &stompFrame{command: command, header: map[string]string{}}
+	for i := 0; i+1 < len(kv); i += 2 {
+		f.header[kv[i]] = kv[i+1]
+	}
+	return f
+}
+
+// maxSTOMPFrame bounds frame bodies so a bad peer can't make us allocate
+// without limit.
+const maxSTOMPFrame = 16 << 20
+
+var (
+	stompEscaper   = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	stompUnescaper = strings.NewReplacer(`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+// readSTOMPFrame reads the next frame, skipping heart-beat newlines. Like the
+// spec says, the first of repeated headers wins.
+func readSTOMPFrame(r *bufio.Reader) (*stompFrame, error) {
+	var command string
+	for command == "" {
+		line, err := readSTOMPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		command = line
+	}
+
+	f := newSTOMPFrame(command)
+	// CONNECT and CONNECTED predate header escaping.
+	escaped := command != "CONNECT" && command != "CONNECTED"
+	for {
+		line, err := readSTOMPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("pubsub: malformed STOMP header %q", line)
+		}
+		if escaped {
+			k, v = stompUnescaper.Replace(k), stompUnescaper.Replace(v)
+		}
+		if _, dup := f.header[k]; !dup {
+			f.header[k] = v
+		}
+	}
+
+	if length, ok := f.header["content-length"]; ok {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > maxSTOMPFrame {
+			return nil, fmt.Errorf("pubsub: bad STOMP content-length %q", length)
+		}
+		f.body = make([]byte, n+1)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return nil, err
+		}
+		if f.body[n] != 0 {
+			return nil, errors.New("pubsub: STOMP frame not terminated by NUL")
+		}
+		f.body = f.body[:n]
+		return f, nil
+	}
+	body, err := r.ReadSlice(0)
+	for errors.Is(err, bufio.ErrBufferFull) {
+		var more []byte
+		more, err = r.ReadSlice(0)
+		body = append(body, more...)
+		if len(body) > maxSTOMPFrame {
+			return nil, errors.New("pubsub: STOMP frame too large")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.body = append([]byte(nil), body[:len(body)-1]...)
+	return f, nil
+}
+
+func readSTOMPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// writeSTOMPFrame writes f and flushes w. Headers are sorted so frames are
+// byte-for-byte reproducible.
+func writeSTOMPFrame(w *bufio.Writer, f *stompFrame) error {
+	escaped := f.command != "CONNECT" && f.command != "CONNECTED"
+	keys := make([]string, 0, len(f.header))
+	for k := range f.header {
+		if k != "content-length" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	w.WriteString(f.command)
+	w.WriteByte('\n')
+	for _, k := range keys {
+		v := f.header[k]
+		if escaped {
+			k, v = stompEscaper.Replace(k), stompEscaper.Replace(v)
+		}
+		w.WriteString(k)
+		w.WriteByte(':')
+		w.WriteString(v)
+		w.WriteByte('\n')
+	}
+	if len(f.body) > 0 {
+		fmt.Fprintf(w, "content-length:%d\n", len(f.body))
+	}
+	w.WriteByte('\n')
+	w.Write(f.body)
+	w.WriteByte(0)
+	return w.Flush()
+}
+
+// Message properties travel as the headers RabbitMQ's STOMP plugin maps them
+// to. Everything else in these sets is STOMP's own business, or a queue
+// argument, and doesn't end up in Message.Headers.
+var (
+	stompProperties = map[string]bool{
+		"content-type": true, "content-length": true, "amqp-message-id": true,
+		"correlation-id": true, "reply-to": true, "app-id": true,
+		"timestamp": true, "persistent": true, "priority": true, "expiration": true,
+	}
+	stompFrameHeaders = map[string]bool{
+		"destination": true, "message-id": true, "subscription": true,
+		"ack": true, "redelivered": true, "receipt": true, "id": true,
+		"x-queue-name": true, "durable": true, "auto-delete": true, "exclusive": true,
+		"prefetch-count": true,
+	}
+	// stompIntArguments are the queue arguments sent as headers that
+	// RabbitMQ reads back as numbers.
+	stompIntArguments = map[string]bool{
+		"x-message-ttl": true, "x-expires": true, "x-max-length": true,
+		"x-max-length-bytes": true, "x-max-priority": true, "x-delivery-limit": true,
+	}
+	stompArguments = map[string]bool{
+		"x-message-ttl": true, "x-expires": true, "x-max-length": true,
+		"x-max-length-bytes": true, "x-max-priority": true, "x-delivery-limit": true,
+		"x-dead-letter-exchange": true, "x-dead-letter-routing-key": true,
+		"x-overflow": true, "x-queue-type": true, "x-queue-mode": true,
+		"x-single-active-consumer": true,
+	}
+)
+
+// setSTOMPMessage puts msg's properties and headers on f. STOMP headers are
+// text, so header values are formatted and nested tables are left out.
+func setSTOMPMessage(f *stompFrame, msg Message) {
+	for k, v := range msg.Headers {
+		if stompProperties[k] || stompFrameHeaders[k] || stompArguments[k] {
+			continue
+		}
+		switch v := v.(type) {
+		case Table, []any:
+		case time.Time:
+			f.header[k] = strconv.FormatInt(v.Unix(), 10)
+		default:
+			f.header[k] = fmt.Sprint(v)
+		}
+	}
+	f.header["persistent"] = "true"
+	setIf := func(k, v string) {
+		if v != "" {
+			f.header[k] = v
+		}
+	}
+	setIf("content-type", msg.ContentType)
+	setIf("amqp-message-id", msg.MessageID)
+	setIf("correlation-id", msg.CorrelationID)
+	setIf("reply-to", msg.ReplyTo)
+	setIf("app-id", msg.AppID)
+	if !msg.Timestamp.IsZero() {
+		f.header["timestamp"] = strconv.FormatInt(msg.Timestamp.Unix(), 10)
+	}
+	f.body = msg.Body
+}
+
+// stompMessage is the inverse of setSTOMPMessage. Header values stay strings;
+// tableInt knows how to read numbers out of them.
+func stompMessage(f *stompFrame) Message {
+	msg := Message{
+		ContentType:   f.header["content-type"],
+		MessageID:     f.header["amqp-message-id"],
+		CorrelationID: f.header["correlation-id"],
+		ReplyTo:       f.header["reply-to"],
+		AppID:         f.header["app-id"],
+		Headers:       Table{},
+		Body:          f.body,
+	}
+	if ts, err := strconv.ParseInt(f.header["timestamp"], 10, 64); err == nil {
+		msg.Timestamp = time.Unix(ts, 0)
+	}
+	for k, v := range f.header {
+		if !stompProperties[k] && !stompFrameHeaders[k] && !stompArguments[k] {
+			msg.Headers[k] = v
+		}
+	}
+	return msg
+}
+
+// setSTOMPQueue puts a queue's properties and arguments on a SUBSCRIBE or
+// SEND frame, which is how the STOMP plugin declares queues.
+func setSTOMPQueue(f *stompFrame, durable, autoDelete, exclusive bool, args Table) {
+	f.header["durable"] = strconv.FormatBool(durable)
+	f.header["auto-delete"] = strconv.FormatBool(autoDelete)
+	f.header["exclusive"] = strconv.FormatBool(exclusive)
+	for k, v := range args {
+		if stompArguments[k] {
+			f.header[k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// stompQueue reads back what setSTOMPQueue wrote. durable defaults to
+// true, like RabbitMQ's /queue destinations.
+func stompQueue(f *stompFrame) (durable, autoDelete, exclusive bool, args Table) {
+	durable = f.header["durable"] != "false"
+	autoDelete = f.header["auto-delete"] == "true"
+	exclusive = f.header["exclusive"] == "true"
+	args = Table{}
+	for k, v := range f.header {
+		if !stompArguments[k] {
+			continue
+		}
+		switch {
+		case stompIntArguments[k]:
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				args[k] = n
+			}
+		case k == "x-single-active-consumer":
+			args[k] = v == "true"
+		default:
+			args[k] = v
+		}
+	}
+	return durable, autoDelete, exclusive, args
+}
+
+// STOMP destinations, as RabbitMQ's STOMP plugin names them. A queue
+// destination goes through the default exchange.
+const (
+	stompExchangePrefix = "/exchange/"
+	stompQueuePrefix    = "/queue/"
+	stompAMQQueuePrefix = "/amq/queue/"
+)
+
+// STOMPDestination names where a message for exchange with key goes:
+// /exchange/peril_topic/army_moves.alice, or /amq/queue/<key> for the default
+// exchange.
+func STOMPDestination(exchange, key string) string {
+	if exchange == "" {
+		return stompAMQQueuePrefix + key
+	}
+	return stompExchangePrefix + exchange + "/" + key
+}
+
+// parseSTOMPDestination splits a destination into exchange and routing key.
+// queue is set for the queue destinations, whose key is a queue name.
+func parseSTOMPDestination(dest string) (exchange, key string, queue bool, err error) {
+	switch {
+	case strings.HasPrefix(dest, stompExchangePrefix):
+		exchange, key, _ = strings.Cut(strings.TrimPrefix(dest, stompExchangePrefix), "/")
+		if exchange == "" {
+			return "", "", false, fmt.Errorf("pubsub: STOMP destination %q has no exchange", dest)
+		}
+		return exchange, key, false, nil
+	case strings.HasPrefix(dest, stompAMQQueuePrefix):
+		key = strings.TrimPrefix(dest, stompAMQQueuePrefix)
+	case strings.HasPrefix(dest, stompQueuePrefix):
+		key = strings.TrimPrefix(dest, stompQueuePrefix)
+	default:
+		return "", "", false, fmt.Errorf("pubsub: unsupported STOMP destination %q", dest)
+	}
+	if key == "" {
+		return "", "", false, fmt.Errorf("pubsub: STOMP destination %q has no queue", dest)
+	}
+	return "", key, true, nil
+}
@@ -0,0 +1,304 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ServeSTOMP accepts STOMP connections on l and acts like RabbitMQ's STOMP
+// plugin in front of b, so STOMP clients (STOMPBroker, a browser, a script)
+// can play with MemoryBroker users without a running RabbitMQ. It supports
+// /exchange, /queue and /amq/queue destinations, queue declaration through
+// SUBSCRIBE and SEND headers, receipts and the auto and client-individual
+// ack modes; client acks are treated as individual ones and transactions
+// are refused. It returns nil once l is closed.
+func ServeSTOMP(l net.Listener, b *MemoryBroker) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s := &stompSession{
+			broker:  b,
+			conn:    conn,
+			r:       bufio.NewReader(conn),
+			w:       bufio.NewWriter(conn),
+			subs:    map[string]Channel{},
+			unacked: map[string]stompUnacked{},
+		}
+		go s.serve()
+	}
+}
+
+// stompSession is one client connection. Every subscription gets its own
+// channel on the session's MemoryConnection, so it can have its own prefetch
+// and be cancelled by closing it.
+type stompSession struct {
+	broker    *MemoryBroker
+	conn      net.Conn
+	r         *bufio.Reader
+	wmu       sync.Mutex
+	w         *bufio.Writer
+	mc        *MemoryConnection
+	publisher Channel
+
+	mu      sync.Mutex
+	subs    map[string]Channel
+	unacked map[string]stompUnacked
+	nextAck uint64
+}
+
+type stompUnacked struct {
+	sub string
+	msg RawDelivery
+}
+
+func (s *stompSession) serve() {
+	defer s.conn.Close()
+
+	f, err := readSTOMPFrame(s.r)
+	if err != nil {
+		return
+	}
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		s.fail(fmt.Errorf("expected CONNECT, got %s", f.command))
+		return
+	}
+	if v, ok := f.header["accept-version"]; ok && !strings.Contains(v, "1.2") {
+		s.fail(fmt.Errorf("only STOMP 1.2 is supported, not %s", v))
+		return
+	}
+	s.mc = s.broker.Dial()
+	// Closing the connection requeues whatever the client didn't ack and
+	// deletes its exclusive queues.
+	defer s.mc.Close()
+	// A broker restart hangs up on STOMP clients too.
+	closed := s.mc.NotifyClose(make(chan error, 1))
+	go func() {
+		if err := <-closed; err != nil {
+			s.fail(err)
+			s.conn.Close()
+		}
+	}()
+	s.publisher, err = s.mc.Channel()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	if err := s.write(newSTOMPFrame("CONNECTED", "version", "1.2", "heart-beat", "0,0", "server", "peril-stomp")); err != nil {
+		return
+	}
+
+	for {
+		f, err := readSTOMPFrame(s.r)
+		if err != nil {
+			return
+		}
+		if err := s.handle(f); err != nil {
+			s.fail(err)
+			return
+		}
+		if receipt, ok := f.header["receipt"]; ok {
+			if err := s.write(newSTOMPFrame("RECEIPT", "receipt-id", receipt)); err != nil {
+				return
+			}
+		}
+		if f.command == "DISCONNECT" {
+			return
+		}
+	}
+}
+
+func (s *stompSession) handle(f *stompFrame) error {
+	switch f.command {
+	case "SEND":
+		return s.send(f)
+	case "SUBSCRIBE":
+		return s.subscribe(f)
+	case "UNSUBSCRIBE":
+		return s.unsubscribe(f.header["id"])
+	case "ACK", "NACK":
+		return s.settle(f)
+	case "DISCONNECT":
+		return nil
+	case "BEGIN", "COMMIT", "ABORT":
+		return errors.New("transactions are not supported")
+	default:
+		return fmt.Errorf("unknown command %s", f.command)
+	}
+}
+
+func (s *stompSession) send(f *stompFrame) error {
+	exchange, key, queue, err := parseSTOMPDestination(f.header["destination"])
+	if err != nil {
+		return err
+	}
+	if queue && strings.HasPrefix(f.header["destination"], stompQueuePrefix) {
+		durable, autoDelete, exclusive, args := stompQueue(f)
+		if _, err := s.publisher.QueueDeclare(key, durable, autoDelete, exclusive, args); err != nil {
+			return err
+		}
+	}
+	return s.publisher.Publish(context.Background(), exchange, key, stompMessage(f))
+}
+
+func (s *stompSession) subscribe(f *stompFrame) error {
+	id := f.header["id"]
+	if id == "" {
+		return errors.New("SUBSCRIBE without an id")
+	}
+	s.mu.Lock()
+	_, dup := s.subs[id]
+	s.mu.Unlock()
+	if dup {
+		return fmt.Errorf("subscription %s already exists", id)
+	}
+	var clientAck bool
+	switch f.header["ack"] {
+	case "", "auto":
+	case "client", "client-individual":
+		clientAck = true
+	default:
+		return fmt.Errorf("unknown ack mode %s", f.header["ack"])
+	}
+
+	ch, err := s.mc.Channel()
+	if err != nil {
+		return err
+	}
+	queue, err := s.declare(ch, f)
+	if err == nil && f.header["prefetch-count"] != "" {
+		var n int
+		n, err = strconv.Atoi(f.header["prefetch-count"])
+		if err == nil {
+			err = ch.Qos(n, 0)
+		}
+	}
+	var deliveries <-chan RawDelivery
+	if err == nil {
+		deliveries, err = ch.Consume(queue, id)
+	}
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	s.subs[id] = ch
+	s.mu.Unlock()
+	go s.deliver(id, clientAck, deliveries)
+	return nil
+}
+
+// declare sets up the queue behind a SUBSCRIBE destination like RabbitMQ
+// does: an exchange destination binds x-queue-name (or a fresh exclusive
+// queue) to the exchange, a /queue destination declares the queue and an
+// /amq/queue destination has to exist already.
+func (s *stompSession) declare(ch Channel, f *stompFrame) (string, error) {
+	exchange, key, queue, err := parseSTOMPDestination(f.header["destination"])
+	if err != nil {
+		return "", err
+	}
+	durable, autoDelete, exclusive, args := stompQueue(f)
+	switch {
+	case !queue:
+		name := f.header["x-queue-name"]
+		if name == "" {
+			name = "stomp-subscription-" + NewMessageID()
+			durable, autoDelete, exclusive = false, true, true
+		}
+		if _, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, args); err != nil {
+			return "", err
+		}
+		return name, ch.QueueBind(name, key, exchange, nil)
+	case strings.HasPrefix(f.header["destination"], stompQueuePrefix):
+		_, err := ch.QueueDeclare(key, durable, autoDelete, exclusive, args)
+		return key, err
+	default:
+		return key, nil
+	}
+}
+
+func (s *stompSession) deliver(sub string, clientAck bool, deliveries <-chan RawDelivery) {
+	for msg := range deliveries {
+		f := newSTOMPFrame("MESSAGE")
+		setSTOMPMessage(f, msg.Message)
+		f.header["subscription"] = sub
+		f.header["destination"] = STOMPDestination(msg.Exchange, msg.RoutingKey)
+		f.header["redelivered"] = strconv.FormatBool(msg.Redelivered)
+
+		s.mu.Lock()
+		s.nextAck++
+		id := strconv.FormatUint(s.nextAck, 10)
+		if clientAck {
+			s.unacked[id] = stompUnacked{sub: sub, msg: msg}
+		}
+		s.mu.Unlock()
+		f.header["message-id"] = id
+		f.header["ack"] = id
+
+		if err := s.write(f); err != nil {
+			return
+		}
+		if !clientAck {
+			msg.Ack()
+		}
+	}
+}
+
+// unsubscribe closes the subscription's channel, which requeues its unacked
+// messages.
+func (s *stompSession) unsubscribe(id string) error {
+	s.mu.Lock()
+	ch, ok := s.subs[id]
+	delete(s.subs, id)
+	for ackID, u := range s.unacked {
+		if u.sub == id {
+			delete(s.unacked, ackID)
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no subscription %s", id)
+	}
+	return ch.Close()
+}
+
+func (s *stompSession) settle(f *stompFrame) error {
+	id := f.header["id"]
+	s.mu.Lock()
+	u, ok := s.unacked[id]
+	delete(s.unacked, id)
+	s.mu.Unlock()
+	// Messages of a subscription that is gone were requeued already.
+	if !ok {
+		return nil
+	}
+	if f.command == "ACK" {
+		return u.msg.Ack()
+	}
+	return u.msg.Nack(f.header["requeue"] != "false")
+}
+
+func (s *stompSession) write(f *stompFrame) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return writeSTOMPFrame(s.w, f)
+}
+
+// fail reports err to the client; the connection is closed afterwards, as
+// the spec requires.
+func (s *stompSession) fail(err error) {
+	f := newSTOMPFrame("ERROR", "message", strings.SplitN(err.Error(), "\n", 2)[0], "content-type", "text/plain")
+	f.body = []byte(err.Error())
+	s.write(f)
+}
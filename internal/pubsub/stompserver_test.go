@@ -0,0 +1,253 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveSTOMP puts a STOMP front end on a fresh MemoryBroker with the game's
+// topic exchange.
+func serveSTOMP(t *testing.T) (*MemoryBroker, string) {
+	t.Helper()
+	b := NewMemoryBroker()
+	conn := b.Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("peril_topic", ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeSTOMP(l, b)
+	t.Cleanup(func() { l.Close() })
+	return b, l.Addr().String()
+}
+
+// stompTestClient speaks raw frames, the way a browser client would.
+type stompTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dialSTOMPTest(t *testing.T, addr string) *stompTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &stompTestClient{t: t, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	c.send("CONNECT", "", "accept-version", "1.2", "host", "/", "login", "guest", "passcode", "guest")
+	c.expect("CONNECTED")
+	return c
+}
+
+func (c *stompTestClient) send(command, body string, kv ...string) {
+	c.t.Helper()
+	f := newSTOMPFrame(command, kv...)
+	f.body = []byte(body)
+	if err := writeSTOMPFrame(c.w, f); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *stompTestClient) expect(command string) *stompFrame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := readSTOMPFrame(c.r)
+	if err != nil {
+		c.t.Fatalf("waiting for %s: %s", command, err)
+	}
+	if f.command != command {
+		c.t.Fatalf("got %s %v %q, want %s", f.command, f.header, f.body, command)
+	}
+	return f
+}
+
+func TestServeSTOMPRoundTrip(t *testing.T) {
+	b, addr := serveSTOMP(t)
+	conn := b.Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(DeadLetterExchange, ExchangeFanout, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("dlq", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("dlq", "", DeadLetterExchange, nil); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := ch.Consume("dlq", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialSTOMPTest(t, addr)
+	c.send("SUBSCRIBE", "",
+		"id", "0",
+		"destination", "/exchange/peril_topic/army_moves.*",
+		"ack", "client-individual",
+		"x-queue-name", "army_moves.bob",
+		"x-dead-letter-exchange", DeadLetterExchange,
+		"receipt", "subscribed",
+	)
+	c.expect("RECEIPT")
+
+	// Two words don't match army_moves.*, so only the second SEND arrives.
+	c.send("SEND", "g1 moved", "destination", "/exchange/peril_topic/army_moves.g1.alice")
+	c.send("SEND", "alice moved", "destination", "/exchange/peril_topic/army_moves.alice", "content-type", "text/plain")
+	msg := c.expect("MESSAGE")
+	if string(msg.body) != "alice moved" || msg.header["subscription"] != "0" || msg.header["redelivered"] != "false" {
+		t.Fatalf("got %q %v, want alice's move for subscription 0", msg.body, msg.header)
+	}
+	if dest := msg.header["destination"]; dest != "/exchange/peril_topic/army_moves.alice" {
+		t.Errorf("destination %s, want the one alice sent to", dest)
+	}
+
+	// A NACK requeues unless it says otherwise.
+	c.send("NACK", "", "id", msg.header["ack"])
+	msg = c.expect("MESSAGE")
+	if string(msg.body) != "alice moved" || msg.header["redelivered"] != "true" {
+		t.Fatalf("got %q %v, want alice's move redelivered", msg.body, msg.header)
+	}
+	c.send("NACK", "", "id", msg.header["ack"], "requeue", "false")
+	d := receive(t, dead)
+	if deaths := Deaths(d.Headers); string(d.Body) != "alice moved" || len(deaths) != 1 || deaths[0].Reason != "rejected" || deaths[0].Queue != "army_moves.bob" {
+		t.Errorf("dead-lettered %q with %+v, want alice's move rejected from army_moves.bob", d.Body, deaths)
+	}
+
+	c.send("SEND", "alice moved again", "destination", "/exchange/peril_topic/army_moves.alice")
+	msg = c.expect("MESSAGE")
+	c.send("ACK", "", "id", msg.header["ack"])
+	// Anything still unacked would be requeued when the session ends.
+	c.send("DISCONNECT", "", "receipt", "bye")
+	c.expect("RECEIPT")
+	deadline := time.Now().Add(time.Second)
+	for {
+		q, err := b.Queue("army_moves.bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Consumers == 0 {
+			if q.Messages != 0 {
+				t.Errorf("%d messages left in army_moves.bob, want the acked one gone", q.Messages)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the session never let go of army_moves.bob")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSTOMPBrokerRestart(t *testing.T) {
+	b, addr := serveSTOMP(t)
+	url := "stomp://guest:guest@" + addr + "/"
+
+	raw, err := DialSTOMP(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := raw.NotifyClose(make(chan error, 1))
+
+	managed, err := DialManaged(url, Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer managed.Close()
+	handled := make(chan string, 2)
+	sub, err := Subscribe(context.Background(), managed, "peril_topic", "army_moves.bob", "army_moves.*", SimpleQueueTypeDurable, func(move string) Acktype {
+		handled <- move
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	publish := func(move string) {
+		t.Helper()
+		conn := b.Dial()
+		defer conn.Close()
+		ch, err := conn.Channel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := PublishJSON(ch, "peril_topic", "army_moves.alice", move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-handled:
+			if got != want {
+				t.Errorf("handled %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was never handled", want)
+		}
+	}
+
+	publish("before")
+	expect("before")
+	// Let the ack reach the broker, or the restart rightly redelivers it.
+	waitSettled(t, b, "army_moves.bob")
+
+	b.Restart()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, ErrConnectionForced) {
+			t.Errorf("plain STOMP connection closed with %v, want ErrConnectionForced", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("plain STOMP connection didn't notice the restart")
+	}
+	if _, err := raw.Channel(); !errors.Is(err, ErrClosed) {
+		t.Errorf("opening a channel after the restart: got %v, want ErrClosed", err)
+	}
+
+	// The managed broker reconnects and resubscribes by itself.
+	publish("after")
+	expect("after")
+}
+
+// waitSettled waits until no consumer of queue holds an unacked message.
+func waitSettled(t *testing.T, b *MemoryBroker, queue string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mu.Lock()
+		unacked := 0
+		if q, ok := b.queues[queue]; ok {
+			for _, c := range q.consumers {
+				unacked += len(c.unacked)
+			}
+		}
+		b.mu.Unlock()
+		if unacked == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages in %s were never acked", unacked, queue)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
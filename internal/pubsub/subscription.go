@@ -0,0 +1,183 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrConsumerCancelled = errors.New("pubsub: consumer cancelled by the broker")
+
+// Subscription is a running consumer started by Subscribe.
+// It stops when its context is cancelled, when Close is called or when the
+// broker cancels the consumer.
+type Subscription struct {
+	channel Channel
+	queue   string
+	tag     string
+
+	// How long the queue lives, which its retry queues mirror.
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	poisoned atomic.Uint64
+
+	prefetchCount int
+	prefetchSize  int
+	workers       int
+	orderingKey   func(RawDelivery) string
+
+	retry        RetryPolicy
+	retryMu      sync.Mutex
+	retryQueues  map[string]bool
+	retried      atomic.Uint64
+	deadLettered atomic.Uint64
+
+	mu       sync.Mutex
+	err      error
+	closeErr error
+}
+
+// newSubscription prepares a subscription for queue. It owns channel from
+// now on and closes it when it stops.
+func newSubscription(channel Channel, queue string) *Subscription {
+	return &Subscription{
+		channel: channel,
+		queue:   queue,
+		tag:     newConsumerTag(),
+		done:    make(chan struct{}),
+
+		prefetchCount: DefaultPrefetchCount,
+		workers:       1,
+
+		retry:       DefaultRetryPolicy,
+		retryQueues: map[string]bool{},
+	}
+}
+
+// start consumes the queue and calls handle for every delivery. The context
+// handle gets is cancelled when the subscription stops.
+func (s *Subscription) start(ctx context.Context, handle func(context.Context, RawDelivery) Acktype) error {
+	if err := s.channel.Qos(s.prefetchCount, s.prefetchSize); err != nil {
+		s.channel.Close()
+		return err
+	}
+
+	deliveries, err := s.channel.Consume(s.queue, s.tag)
+	if err != nil {
+		s.channel.Close()
+		return err
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	go s.run(ctx, deliveries, handle)
+	return nil
+}
+
+func (s *Subscription) run(ctx context.Context, deliveries <-chan RawDelivery, handle func(context.Context, RawDelivery) Acktype) {
+	defer close(s.done)
+	defer s.cancel()
+
+	pool := newWorkerPool(s.workers, s.orderingKey, func(msg RawDelivery) {
+		// A worker may pick up a message after we've been asked to stop.
+		if ctx.Err() != nil {
+			msg.Nack(true)
+			return
+		}
+		s.ack(msg, handle(ctx, msg))
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			pool.wait()
+			s.stop(ctx.Err(), deliveries)
+			return
+		case msg, ok := <-deliveries:
+			if !ok {
+				pool.wait()
+				s.setErr(ErrConsumerCancelled)
+				s.closeErr = s.channel.Close()
+				return
+			}
+			// select picks at random when both are ready; don't start a
+			// handler once we've been asked to stop.
+			if ctx.Err() != nil || !pool.submit(ctx, msg) {
+				msg.Nack(true)
+				pool.wait()
+				s.stop(ctx.Err(), deliveries)
+				return
+			}
+		}
+	}
+}
+
+func (s *Subscription) ack(msg RawDelivery, acktype Acktype) {
+	// Depending on the returned "acktype", the goroutine that calls the handler should either call...
+	switch acktype {
+	case Ack:
+		msg.Ack()
+	case NackRequeue:
+		msg.Nack(true)
+	case NackDiscard:
+		msg.Nack(false)
+	case NackRetry:
+		s.retryLater(msg)
+	}
+}
+
+// stop cancels the consumer, puts back whatever the broker had already sent
+// us and closes the channel. The handler is never running at this point.
+func (s *Subscription) stop(reason error, deliveries <-chan RawDelivery) {
+	s.setErr(reason)
+	if err := s.channel.Cancel(s.tag); err == nil {
+		for msg := range deliveries {
+			msg.Nack(true)
+		}
+	}
+	s.closeErr = s.channel.Close()
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Close stops consuming, waits for the handler that is running (if any) to
+// return and closes the subscription's channel.
+func (s *Subscription) Close() error {
+	s.setErr(ErrClosed)
+	s.cancel()
+	<-s.done
+	if errors.Is(s.closeErr, ErrClosed) {
+		return nil
+	}
+	return s.closeErr
+}
+
+// Done is closed once the subscription has stopped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err is nil while the subscription runs. Afterwards it says why it stopped:
+// ErrClosed after Close, the context's error, or ErrConsumerCancelled.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Poisoned counts the deliveries that could not be decoded and were
+// dead-lettered instead of reaching the handler.
+func (s *Subscription) Poisoned() uint64 {
+	return s.poisoned.Load()
+}
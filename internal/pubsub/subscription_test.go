@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func expectStopped(t *testing.T, sub *Subscription, want error) {
+	t.Helper()
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the subscription is still running")
+	}
+	if err := sub.Err(); !errors.Is(err, want) {
+		t.Errorf("Err() = %v, want %v", err, want)
+	}
+}
+
+func TestSubscriptionCloseStopsDelivery(t *testing.T) {
+	handled := make(chan string, 2)
+	b, ch, sub := workerSubscription(t, func(body string) Acktype {
+		handled <- body
+		return Ack
+	})
+	if err := sub.Err(); err != nil {
+		t.Errorf("Err() = %v while running", err)
+	}
+	if err := PublishJSON(ch, "peril_topic", "game_logs.alice", "before"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("nothing handled before Close")
+	}
+
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectStopped(t, sub, ErrClosed)
+	if err := PublishJSON(ch, "peril_topic", "game_logs.alice", "after"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-handled:
+		t.Errorf("handled %q after Close", body)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if q, err := b.Queue("game_logs"); err != nil || q.Messages != 1 || q.Consumers != 0 {
+		t.Errorf("queue has %d messages and %d consumers (%v), want the one published after Close and none", q.Messages, q.Consumers, err)
+	}
+}
+
+func TestSubscriptionStopsWithContext(t *testing.T) {
+	b, ch := memoryChannel(t)
+	if err := ch.ExchangeDeclare("peril_direct", ExchangeDirect, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := b.Dial()
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := Subscribe(ctx, conn, "peril_direct", "pause", "pause", SimpleQueueTypeDurable, func(string) Acktype { return Ack })
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	expectStopped(t, sub, context.Canceled)
+	if err := sub.Close(); err != nil {
+		t.Errorf("closing a stopped subscription: %v", err)
+	}
+}
+
+func TestSubscriptionStopsWhenBrokerCancels(t *testing.T) {
+	b, ch := memoryChannel(t)
+	if err := ch.ExchangeDeclare("peril_direct", ExchangeDirect, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := b.Dial()
+	defer conn.Close()
+	sub, err := Subscribe(context.Background(), conn, "peril_direct", "pause", "pause", SimpleQueueTypeTransient, func(string) Acktype { return Ack })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A restart takes the transient queue, and the consumer, with it.
+	b.Restart()
+	expectStopped(t, sub, ErrConsumerCancelled)
+}
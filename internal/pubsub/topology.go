@@ -0,0 +1,294 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Topology describes the exchanges, shared queues and bindings a game needs,
+// so a fresh broker can be set up without clicking through the management UI.
+// Per-player queues are still declared by the clients themselves.
+type Topology struct {
+	Exchanges []TopologyExchange `json:"exchanges" yaml:"exchanges"`
+	Queues    []TopologyQueue    `json:"queues" yaml:"queues"`
+	Bindings  []TopologyBinding  `json:"bindings" yaml:"bindings"`
+}
+
+type TopologyExchange struct {
+	Name    string `json:"name" yaml:"name"`
+	Kind    string `json:"kind" yaml:"kind"`
+	Durable bool   `json:"durable" yaml:"durable"`
+}
+
+// TopologyQueue mirrors the QueueOptions. Leaving DeadLetterExchange out means
+// DeadLetterExchange, like every other queue; set it to "" to turn
+// dead-lettering off (the dead-letter queue itself wants that).
+type TopologyQueue struct {
+	Name               string         `json:"name" yaml:"name"`
+	Durable            bool           `json:"durable" yaml:"durable"`
+	Type               string         `json:"type,omitempty" yaml:"type,omitempty"`
+	DeadLetterExchange *string        `json:"dead_letter_exchange,omitempty" yaml:"dead_letter_exchange,omitempty"`
+	MessageTTLMillis   int64          `json:"message_ttl_ms,omitempty" yaml:"message_ttl_ms,omitempty"`
+	MaxLength          int            `json:"max_length,omitempty" yaml:"max_length,omitempty"`
+	Overflow           string         `json:"overflow,omitempty" yaml:"overflow,omitempty"`
+	Arguments          map[string]any `json:"arguments,omitempty" yaml:"arguments,omitempty"`
+}
+
+type TopologyBinding struct {
+	Exchange string `json:"exchange" yaml:"exchange"`
+	Queue    string `json:"queue" yaml:"queue"`
+	Key      string `json:"key" yaml:"key"`
+}
+
+// LoadTopology reads a topology from a .yaml, .yml or .json file.
+func LoadTopology(path string) (Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, err
+	}
+	return ParseTopology(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// ParseTopology decodes data as "json" or "yaml" and checks it.
+func ParseTopology(data []byte, format string) (Topology, error) {
+	var t Topology
+	var err error
+	switch format {
+	case "json":
+		err = json.Unmarshal(data, &t)
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, &t)
+	default:
+		return Topology{}, fmt.Errorf("pubsub: unknown topology format %q", format)
+	}
+	if err != nil {
+		return Topology{}, fmt.Errorf("pubsub: could not parse topology: %w", err)
+	}
+	if err := t.Validate(); err != nil {
+		return Topology{}, err
+	}
+	return t, nil
+}
+
+func (q TopologyQueue) spec() QueueSpec {
+	var opts []QueueOption
+	switch q.Type {
+	case QueueTypeQuorum:
+		opts = append(opts, Quorum())
+	case QueueTypeStream:
+		opts = append(opts, Stream())
+	case "", QueueTypeClassic:
+	default:
+		opts = append(opts, func(s *QueueSpec) { s.Type = q.Type })
+	}
+	if q.DeadLetterExchange != nil {
+		opts = append(opts, WithDeadLetterExchange(*q.DeadLetterExchange))
+	}
+	if q.MessageTTLMillis > 0 {
+		opts = append(opts, WithMessageTTL(time.Duration(q.MessageTTLMillis)*time.Millisecond))
+	}
+	if q.MaxLength > 0 || q.Overflow != "" {
+		opts = append(opts, WithMaxLength(q.MaxLength, q.Overflow))
+	}
+	for k, v := range q.Arguments {
+		opts = append(opts, WithArgument(k, v))
+	}
+
+	// Topology queues are shared, so never exclusive or auto-deleted.
+	spec := NewQueueSpec(SimpleQueueTypeDurable, opts...)
+	spec.Durable = q.Durable
+	return spec
+}
+
+// Validate checks that every queue is declarable and every binding refers to
+// an exchange and queue in the topology.
+func (t Topology) Validate() error {
+	var errs []error
+	exchanges := map[string]bool{}
+	for _, ex := range t.Exchanges {
+		switch ex.Kind {
+		case ExchangeDirect, ExchangeTopic, ExchangeFanout:
+		default:
+			errs = append(errs, fmt.Errorf("exchange %s: unsupported kind %q", ex.Name, ex.Kind))
+		}
+		exchanges[ex.Name] = true
+	}
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			errs = append(errs, errors.New("queue without a name"))
+		}
+		if err := q.spec().Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("queue %s: %w", q.Name, err))
+		}
+		queues[q.Name] = true
+	}
+	for _, bnd := range t.Bindings {
+		if !exchanges[bnd.Exchange] {
+			errs = append(errs, fmt.Errorf("binding %s: unknown exchange %s", bnd, bnd.Exchange))
+		}
+		if !queues[bnd.Queue] {
+			errs = append(errs, fmt.Errorf("binding %s: unknown queue %s", bnd, bnd.Queue))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("pubsub: invalid topology: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// RenameExchanges returns a copy of t with the exchanges in names, and the
+// bindings to them, renamed to names[exchange].
+func (t Topology) RenameExchanges(names map[string]string) Topology {
+	rename := func(name string) string {
+		if to, ok := names[name]; ok {
+			return to
+		}
+		return name
+	}
+	renamed := Topology{
+		Exchanges: make([]TopologyExchange, len(t.Exchanges)),
+		Queues:    t.Queues,
+		Bindings:  make([]TopologyBinding, len(t.Bindings)),
+	}
+	for i, ex := range t.Exchanges {
+		ex.Name = rename(ex.Name)
+		renamed.Exchanges[i] = ex
+	}
+	for i, bnd := range t.Bindings {
+		bnd.Exchange = rename(bnd.Exchange)
+		renamed.Bindings[i] = bnd
+	}
+	return renamed
+}
+
+func (b TopologyBinding) String() string {
+	return fmt.Sprintf("%s -[%s]-> %s", b.Exchange, b.Key, b.Queue)
+}
+
+// Declare creates everything in the topology. Declarations are idempotent, so
+// it is safe to run on every start.
+func (t Topology) Declare(ch Channel) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	for _, ex := range t.Exchanges {
+		if err := ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, nil); err != nil {
+			return fmt.Errorf("declaring exchange %s: %w", ex.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		spec := q.spec()
+		if _, err := ch.QueueDeclare(q.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, spec.Arguments()); err != nil {
+			return fmt.Errorf("declaring queue %s: %w", q.Name, err)
+		}
+	}
+	for _, bnd := range t.Bindings {
+		if err := ch.QueueBind(bnd.Queue, bnd.Key, bnd.Exchange, nil); err != nil {
+			return fmt.Errorf("binding %s: %w", bnd, err)
+		}
+	}
+	return nil
+}
+
+// Inspector looks up what already exists on a broker, for Topology.Diff.
+// InspectExchange returns an empty kind when the broker can't tell,
+// BindingExists returns errors.ErrUnsupported when bindings can't be listed
+// (plain AMQP has no way to ask), and CheckQueue returns it when a queue's
+// arguments can't be read.
+type Inspector interface {
+	InspectExchange(name string) (kind string, exists bool, err error)
+	QueueExists(name string) (bool, error)
+	BindingExists(queue, key, exchange string) (bool, error)
+	// CheckQueue returns an ErrPreconditionFailed error if the existing
+	// queue name would refuse to be declared again with durable and args.
+	CheckQueue(name string, durable bool, args Table) error
+}
+
+// Change is one thing Declare would do to the broker.
+type Change struct {
+	Object string // "exchange", "queue" or "binding"
+	Name   string
+	Detail string
+	// Unverified is set when the inspector couldn't tell whether the object
+	// exists; Declare will (re)declare it anyway.
+	Unverified bool
+}
+
+func (c Change) String() string {
+	mark := "+"
+	if c.Unverified {
+		mark = "?"
+	}
+	s := fmt.Sprintf("%s %s %s", mark, c.Object, c.Name)
+	if c.Detail != "" {
+		s += " (" + c.Detail + ")"
+	}
+	return s
+}
+
+// Diff is the dry run of Declare: it lists what is missing from the broker
+// without changing anything.
+func (t Topology) Diff(insp Inspector) ([]Change, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	var changes []Change
+	for _, ex := range t.Exchanges {
+		kind, exists, err := insp.InspectExchange(ex.Name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !exists:
+			changes = append(changes, Change{Object: "exchange", Name: ex.Name, Detail: ex.Kind})
+		case kind != "" && kind != ex.Kind:
+			// Declare will fail on this one; say so now.
+			return changes, fmt.Errorf("pubsub: exchange %s is %s, topology wants %s", ex.Name, kind, ex.Kind)
+		}
+	}
+	for _, q := range t.Queues {
+		exists, err := insp.QueueExists(q.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			detail := "transient"
+			if q.Durable {
+				detail = "durable"
+			}
+			changes = append(changes, Change{Object: "queue", Name: q.Name, Detail: detail})
+			continue
+		}
+		spec := q.spec()
+		err = insp.CheckQueue(q.Name, spec.Durable, spec.Arguments())
+		if errors.Is(err, ErrPreconditionFailed) {
+			// Declare will fail on this one too.
+			return changes, fmt.Errorf("pubsub: queue %s doesn't match the topology: %w", q.Name, err)
+		}
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return nil, err
+		}
+	}
+	for _, bnd := range t.Bindings {
+		exists, err := insp.BindingExists(bnd.Queue, bnd.Key, bnd.Exchange)
+		if errors.Is(err, errors.ErrUnsupported) {
+			changes = append(changes, Change{Object: "binding", Name: bnd.String(), Unverified: true})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			changes = append(changes, Change{Object: "binding", Name: bnd.String()})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testTopology = `
+exchanges:
+  - name: peril_topic
+    kind: topic
+    durable: true
+  - name: peril_dlx
+    kind: fanout
+    durable: true
+queues:
+  - name: peril_dlq
+    durable: true
+    dead_letter_exchange: ""
+  - name: rpc.move
+    durable: true
+    message_ttl_ms: 5000
+    arguments:
+      x-single-active-consumer: true
+bindings:
+  - exchange: peril_dlx
+    queue: peril_dlq
+    key: ""
+  - exchange: peril_topic
+    queue: rpc.move
+    key: rpc.move
+`
+
+func parseTestTopology(t *testing.T, yaml string) Topology {
+	t.Helper()
+	topology, err := ParseTopology([]byte(yaml), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topology
+}
+
+func TestTopologyDiff(t *testing.T) {
+	b, ch := memoryChannel(t)
+	topology := parseTestTopology(t, testTopology)
+
+	changes, err := topology.Diff(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 exchanges, 2 queues and 2 bindings.
+	if len(changes) != 6 {
+		t.Errorf("an empty broker is missing %v, want all 6 objects", changes)
+	}
+
+	if err := topology.Declare(ch); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = topology.Diff(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("declared topology still differs: %v", changes)
+	}
+	// Declaring twice is harmless.
+	if err := topology.Declare(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := parseTestTopology(t, strings.Replace(testTopology, "message_ttl_ms: 5000", "message_ttl_ms: 10000", 1))
+	_, err = changed.Diff(b)
+	if !errors.Is(err, ErrPreconditionFailed) || !strings.Contains(err.Error(), "rpc.move") || !strings.Contains(err.Error(), "x-message-ttl") {
+		t.Errorf("diff with another TTL: got %v, want the mismatched argument", err)
+	}
+	if err := changed.Declare(ch); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("declaring another TTL: got %v, want ErrPreconditionFailed", err)
+	}
+
+	retyped := parseTestTopology(t, strings.Replace(testTopology, "kind: fanout", "kind: direct", 1))
+	if _, err := retyped.Diff(b); err == nil || !strings.Contains(err.Error(), "peril_dlx is fanout") {
+		t.Errorf("diff with another exchange kind: got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package pubsub
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+// ByRoutingKey is an ordering key for WithOrderingKey. Peril routing keys end
+// with the username, so each player's messages stay in order.
+func ByRoutingKey(msg RawDelivery) string {
+	return msg.RoutingKey
+}
+
+// workerPool runs a subscription's handler on up to n goroutines. With an
+// ordering key, messages with the same key always go to the same worker and
+// are handled in the order they arrived.
+type workerPool struct {
+	work   func(RawDelivery)
+	key    func(RawDelivery) string
+	queues []chan RawDelivery
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(n int, key func(RawDelivery) string, work func(RawDelivery)) *workerPool {
+	p := &workerPool{work: work, key: key}
+	if n <= 1 {
+		return p
+	}
+
+	shared := make(chan RawDelivery)
+	for i := 0; i < n; i++ {
+		queue := shared
+		if key != nil {
+			queue = make(chan RawDelivery)
+			p.queues = append(p.queues, queue)
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range queue {
+				work(msg)
+			}
+		}()
+	}
+	if key == nil {
+		p.queues = []chan RawDelivery{shared}
+	}
+	return p
+}
+
+// submit hands msg to a worker, or handles it right away when there is no
+// pool. It returns false if ctx was cancelled while every worker was busy.
+func (p *workerPool) submit(ctx context.Context, msg RawDelivery) bool {
+	if p.queues == nil {
+		p.work(msg)
+		return true
+	}
+
+	queue := p.queues[0]
+	if p.key != nil {
+		h := fnv.New32a()
+		h.Write([]byte(p.key(msg)))
+		queue = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+	select {
+	case queue <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// wait stops the workers and waits for the handlers that are running.
+func (p *workerPool) wait() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.queues = nil
+	p.wg.Wait()
+}
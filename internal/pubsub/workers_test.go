@@ -0,0 +1,174 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// workerSubscription subscribes handler to game_logs.* on a MemoryBroker with
+// the given options. The queue is durable, so it outlives the subscription.
+func workerSubscription(t *testing.T, handler func(string) Acktype, opts ...SubscribeOption) (*MemoryBroker, Channel, *Subscription) {
+	t.Helper()
+	b, ch := memoryChannel(t)
+	if err := ch.ExchangeDeclare("peril_topic", ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := b.Dial()
+	t.Cleanup(func() { conn.Close() })
+	sub, err := Subscribe(context.Background(), conn, "peril_topic", "game_logs", "game_logs.*", SimpleQueueTypeDurable, handler, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return b, ch, sub
+}
+
+func TestOrderingKeyKeepsPublishOrder(t *testing.T) {
+	const perPlayer = 50
+	players := []string{"alice", "bob", "carol"}
+	var mu sync.Mutex
+	handled := map[string][]int{}
+	all := make(chan struct{}, perPlayer*len(players))
+	_, ch, _ := workerSubscription(t, func(body string) Acktype {
+		var username string
+		var n int
+		fmt.Sscanf(body, "%s %d", &username, &n)
+		// Uneven handling times would reorder messages sharing a worker
+		// without the key.
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		mu.Lock()
+		handled[username] = append(handled[username], n)
+		mu.Unlock()
+		all <- struct{}{}
+		return Ack
+	}, WithWorkers(4), WithPrefetch(100, 0), WithOrderingKey(ByRoutingKey))
+
+	for n := 0; n < perPlayer; n++ {
+		for _, username := range players {
+			if err := PublishJSON(ch, "peril_topic", "game_logs."+username, fmt.Sprintf("%s %d", username, n)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < perPlayer*len(players); i++ {
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d messages handled", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, username := range players {
+		for i, n := range handled[username] {
+			if n != i {
+				t.Fatalf("%s's messages handled in order %v", username, handled[username])
+			}
+		}
+	}
+}
+
+func TestOrderingKeysRunConcurrently(t *testing.T) {
+	const workers = 4
+	worker := func(key string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return h.Sum32() % workers
+	}
+	// Find two players whose messages go to different workers.
+	keys := []string{"game_logs.alice"}
+	for i := 0; len(keys) < 2; i++ {
+		if key := fmt.Sprintf("game_logs.player%d", i); worker(key) != worker(keys[0]) {
+			keys = append(keys, key)
+		}
+	}
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	defer close(release)
+	_, ch, _ := workerSubscription(t, func(body string) Acktype {
+		started <- body
+		<-release
+		return Ack
+	}, WithWorkers(workers), WithPrefetch(10, 0), WithOrderingKey(ByRoutingKey))
+
+	for _, key := range keys {
+		if err := PublishJSON(ch, "peril_topic", key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second handler starts while the first is still blocked.
+	for range keys {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("messages with different keys were not handled at the same time")
+		}
+	}
+}
+
+func TestWorkerPoolShutsDown(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []string
+	b, ch, sub := workerSubscription(t, func(body string) Acktype {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		handled = append(handled, body)
+		mu.Unlock()
+		return Ack
+	}, WithWorkers(3), WithPrefetch(10, 0))
+
+	for i := 0; i < 6; i++ {
+		if err := PublishJSON(ch, "peril_topic", "game_logs.alice", fmt.Sprint("log ", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of 3 workers busy", i)
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- sub.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while handlers were running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close never returned")
+	}
+
+	mu.Lock()
+	if len(handled) != 3 {
+		t.Errorf("%d handlers finished, want the 3 that were running: %s", len(handled), strings.Join(handled, ", "))
+	}
+	mu.Unlock()
+	// Whatever no worker had started on goes back to the queue.
+	q, err := b.Queue("game_logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Messages != 3 || q.Consumers != 0 {
+		t.Errorf("queue has %d messages and %d consumers after Close, want 3 and none", q.Messages, q.Consumers)
+	}
+}
@@ -8,6 +8,39 @@ type PlayingState struct {
 
 type GameLog struct {
 	CurrentTime time.Time
+	GameID      string
 	Message     string
 	Username    string
 }
+
+// Senders are who may have signed the log: the player it is about, or the
+// server, which logs the wars a player starts.
+func (gl GameLog) Senders() []string {
+	return []string{PlayerIdentity(gl.GameID, gl.Username), ServerIdentity}
+}
+
+// PresenceStatus says what a Presence announces.
+type PresenceStatus string
+
+const (
+	PresenceJoin      PresenceStatus = "join"
+	PresenceHeartbeat PresenceStatus = "heartbeat"
+	PresenceLeave     PresenceStatus = "leave"
+	// Only the server sends drops, for players whose heartbeats stopped.
+	PresenceDrop PresenceStatus = "drop"
+)
+
+// Presence is a player's heartbeat, or the server's notice that a player
+// joined, left or dropped.
+type Presence struct {
+	GameID   string
+	Username string
+	Status   PresenceStatus
+	Time     time.Time
+}
+
+// Sender is who has to have signed a player's presence. The server's
+// notices are signed by the server instead.
+func (p Presence) Sender() string {
+	return PlayerIdentity(p.GameID, p.Username)
+}
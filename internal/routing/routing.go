@@ -1,5 +1,13 @@
 package routing
 
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Keys and queue names are scoped to a game: moves in game g1 are published
+// as army_moves.g1.<username>, and g1's pauses as pause.g1.
 const (
 	ArmyMovesPrefix = "army_moves"
 
@@ -8,9 +16,58 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	// Players announce themselves on presence.<game>.<username>; the
+	// server tells the game's players who joined and who left on
+	// lobby.<game>.<username>.
+	PresencePrefix = "presence"
+	LobbyPrefix    = "lobby"
+
+	// PlayingStateRPCKey asks the server whether the game is paused.
+	PlayingStateRPCKey = "rpc.playing_state"
+
+	// RegisterRPCKey reserves a username in a game until its player leaves.
+	RegisterRPCKey = "rpc.register"
+
+	// Players ask the server to spawn and move their units, and for the
+	// units they have when they join. The server owns the game world.
+	SpawnRPCKey  = "rpc.spawn"
+	MoveRPCKey   = "rpc.move"
+	PlayerRPCKey = "rpc.player"
 )
 
+// Players send a heartbeat every HeartbeatInterval. The server takes a
+// player who misses MissedHeartbeats in a row for gone.
 const (
+	HeartbeatInterval = 5 * time.Second
+	MissedHeartbeats  = 3
+)
+
+// The exchanges Peril publishes to. A deployment sharing its broker can
+// rename them in its configuration; topology.yaml declares the defaults.
+var (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
 )
+
+// GameKey scopes a key or queue name to a game, e.g. GameKey(ArmyMovesPrefix,
+// "g1", "alice") is "army_moves.g1.alice".
+func GameKey(prefix, gameID string, parts ...string) string {
+	return strings.Join(append([]string{prefix, gameID}, parts...), ".")
+}
+
+// ServerIdentity signs everything the server publishes. Players sign as
+// PlayerIdentity, with the key the server gave them when they registered.
+const ServerIdentity = "server"
+
+func PlayerIdentity(gameID, username string) string {
+	return gameID + "/" + username
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ValidName reports whether name can be used as a username or a game ID.
+// Both end up in routing keys and queue names, so dots and wildcards are out.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
@@ -0,0 +1,72 @@
+package routing_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestGameLogsStayInTheirGame(t *testing.T) {
+	ctx := context.Background()
+	conn := pubsub.NewMemoryBroker().Dial()
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(routing.ExchangePerilTopic, pubsub.ExchangeTopic, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(queue, gameID string) <-chan routing.GameLog {
+		t.Helper()
+		logs := make(chan routing.GameLog, 2)
+		sub, err := pubsub.Subscribe(ctx, conn, routing.ExchangePerilTopic, queue, routing.GameKey(routing.GameLogSlug, gameID, "*"), pubsub.SimpleQueueTypeTransient,
+			func(gl routing.GameLog) pubsub.Acktype {
+				logs <- gl
+				return pubsub.Ack
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sub.Close() })
+		return logs
+	}
+	logsA := subscribe("game_logs.a", "a")
+	logsB := subscribe("game_logs.b", "b")
+	allLogs := subscribe("game_logs.all", "*")
+
+	for _, gl := range []routing.GameLog{
+		{GameID: "a", Username: "alice", Message: "alice spawned in a"},
+		{GameID: "b", Username: "alice", Message: "alice spawned in b"},
+	} {
+		if err := pubsub.PublishJSON(ch, routing.ExchangePerilTopic, routing.GameKey(routing.GameLogSlug, gl.GameID, gl.Username), gl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(logs <-chan routing.GameLog, wants ...string) {
+		t.Helper()
+		for _, want := range wants {
+			select {
+			case gl := <-logs:
+				if gl.Message != want {
+					t.Errorf("got %q, want %q", gl.Message, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%q never arrived", want)
+			}
+		}
+		select {
+		case gl := <-logs:
+			t.Errorf("got %q from another game", gl.Message)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	expect(logsA, "alice spawned in a")
+	expect(logsB, "alice spawned in b")
+	expect(allLogs, "alice spawned in a", "alice spawned in b")
+}
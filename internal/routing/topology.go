@@ -0,0 +1,9 @@
+package routing
+
+import _ "embed"
+
+// TopologyYAML describes the Peril exchanges, shared queues and bindings, for
+// pubsub.ParseTopology.
+//
+//go:embed topology.yaml
+var TopologyYAML []byte